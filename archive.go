@@ -0,0 +1,45 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// zipEntrySeparator separates the archive from the entry in ARCHIVE.zip:PATH
+const zipEntrySeparator = ".zip:"
+
+// isZipEntry reports whether an input names an entry inside a zip archive
+func isZipEntry(input string) bool {
+	return strings.Index(strings.ToLower(input), zipEntrySeparator) > 0
+}
+
+// readZipEntry reads an entry from a zip archive, given as ARCHIVE.zip:PATH,
+// of up to maxSize bytes once uncompressed
+func readZipEntry(input string, maxSize int64) ([]byte, error) {
+	i := strings.Index(strings.ToLower(input), zipEntrySeparator) + len(".zip")
+	archivePath, entryName := input[:i], path.Clean(strings.TrimPrefix(input[i+1:], "/"))
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening zip archive %s: %w", archivePath, err)
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if path.Clean(file.Name) != entryName {
+			continue
+		}
+
+		entry, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s in %s: %w", entryName, archivePath, err)
+		}
+		defer entry.Close()
+
+		return readAllLimited(entry, maxSize)
+	}
+
+	return nil, fmt.Errorf("entry %s not found in zip archive %s", entryName, archivePath)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// isTextContent reports whether decrypted binary content can be diffed line
+// by line: valid UTF-8 without NUL bytes, the same test git uses to tell text
+// from binary files
+func isTextContent(content []byte) bool {
+	return utf8.Valid(content) && bytes.IndexByte(content, 0) < 0
+}
+
+// diffBinaryContent compares two files encrypted with the SOPS binary store.
+// Their content has no structure to compare key by key, so text is diffed
+// line by line as it is, and anything else is only reported as differing.
+func diffBinaryContent(file1Path, file2Path string, decrypted1, decrypted2 []byte, options DiffOptions) error {
+	if options.DiffTool != "" {
+		return diffWithExternalTool(string(decrypted1), string(decrypted2), "binary", options)
+	}
+
+	if !isTextContent(decrypted1) || !isTextContent(decrypted2) {
+		if bytes.Equal(decrypted1, decrypted2) {
+			return writeDiff("", options)
+		}
+		return writeDiff(fmt.Sprintf("Binary files %s and %s differ\n", file1Path, file2Path), options)
+	}
+
+	diff := truncateLines(generateDiff(file1Path, file2Path, string(decrypted1), string(decrypted2), options), options.MaxLines, "lines")
+	return writeDiff(diff, options)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/getsops/sops/v3/version"
+)
+
+// decryptionCache stores decrypted plaintext keyed by a hash of the ciphertext.
+// Entries are plaintext, so the cache directory should live on a tmpfs and is
+// only used when explicitly enabled with --cache.
+type decryptionCache struct {
+	dir string
+	// decryptor names the backend and its version, so upgrading sops
+	// or switching --decryptor never serves stale entries
+	decryptor string
+}
+
+// newDecryptionCache prepares the cache directory for entries decrypted by
+// decryptor. Without an explicit directory, the per-user runtime directory
+// (usually a tmpfs) is used.
+func newDecryptionCache(dir, decryptor string) (*decryptionCache, error) {
+	if dir == "" {
+		runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+		if runtimeDir == "" {
+			return nil, fmt.Errorf("--cache requires --cache-dir when XDG_RUNTIME_DIR is not set (use a tmpfs path, cached entries are plaintext)")
+		}
+		dir = filepath.Join(runtimeDir, "sops-diff")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating cache directory %s: %w", dir, err)
+	}
+
+	// MkdirAll leaves the mode of an existing directory alone
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache directory %s: %w", dir, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return nil, fmt.Errorf("cache directory %s is accessible by other users and could not be restricted: %w", dir, err)
+		}
+	}
+
+	return &decryptionCache{dir: dir, decryptor: decryptor}, nil
+}
+
+// sopsBinaryVersions holds the output of sops --version per binary, asked
+// for once even when decryptPair decrypts two files at a time
+var (
+	sopsBinaryVersionsMu sync.Mutex
+	sopsBinaryVersions   = make(map[string]string)
+)
+
+// cacheDecryptor names the backend that decrypts for the cache key: the
+// version of the SOPS library built in, or the version the sops binary
+// reports for --decryptor=binary
+func cacheDecryptor(backend string, options DiffOptions) (string, error) {
+	if backend != decryptorBinary {
+		return decryptorLibrary + " " + version.Version, nil
+	}
+
+	sopsBin, err := lookupSopsBinary(options)
+	if err != nil {
+		return "", err
+	}
+
+	sopsBinaryVersionsMu.Lock()
+	defer sopsBinaryVersionsMu.Unlock()
+	if v, ok := sopsBinaryVersions[sopsBin]; ok {
+		return v, nil
+	}
+
+	// The upstream version check would make the output depend on the
+	// network; releases without the flag don't run it
+	output, err := exec.Command(sopsBin, "--disable-version-check", "--version").Output()
+	if err != nil {
+		output, err = exec.Command(sopsBin, "--version").Output()
+		if err != nil {
+			return "", fmt.Errorf("error running %s --version: %w", sopsBin, err)
+		}
+	}
+	firstLine := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0]
+	v := decryptorBinary + " " + strings.TrimSuffix(firstLine, " (latest)")
+
+	sopsBinaryVersions[sopsBin] = v
+	return v, nil
+}
+
+// key derives the cache entry name from the decryptor, format and ciphertext,
+// so any change to the encrypted content results in a different entry
+func (c *decryptionCache) key(content []byte, format string) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.decryptor))
+	hash.Write([]byte{0})
+	hash.Write([]byte(format))
+	hash.Write([]byte{0})
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the cached plaintext, if present
+func (c *decryptionCache) get(content []byte, format string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, c.key(content, format)))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores the plaintext with owner-only permissions
+func (c *decryptionCache) put(content []byte, format string, plaintext []byte) error {
+	path := filepath.Join(c.dir, c.key(content, format))
+	if err := ioutil.WriteFile(path, plaintext, 0600); err != nil {
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+	return nil
+}
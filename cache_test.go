@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptionCacheKeyDependsOnDecryptor(t *testing.T) {
+	dir := t.TempDir()
+	library, err := newDecryptionCache(dir, "library 3.9.4")
+	require.NoError(t, err)
+	binary, err := newDecryptionCache(dir, "binary sops 3.9.4")
+	require.NoError(t, err)
+	upgraded, err := newDecryptionCache(dir, "binary sops 3.10.0")
+	require.NoError(t, err)
+
+	content := []byte("data: ENC[AES256_GCM,data:abc]\n")
+	require.NoError(t, binary.put(content, "yaml", []byte("data: secret\n")))
+
+	plaintext, ok := binary.get(content, "yaml")
+	assert.True(t, ok)
+	assert.Equal(t, "data: secret\n", string(plaintext))
+
+	_, ok = library.get(content, "yaml")
+	assert.False(t, ok)
+	_, ok = upgraded.get(content, "yaml")
+	assert.False(t, ok)
+	_, ok = binary.get(content, "json")
+	assert.False(t, ok)
+}
+
+func TestDecryptionCacheRestrictsExistingDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix permission bits")
+	}
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	_, err := newDecryptionCache(dir, "library")
+	require.NoError(t, err)
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestCacheDecryptorUsesSopsBinaryVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake sops binary is a shell script")
+	}
+
+	fakeSops := func(output string) string {
+		path := filepath.Join(t.TempDir(), "sops")
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\necho '"+output+"'\n"), 0700))
+		return path
+	}
+
+	options := testOptions()
+	decryptor, err := cacheDecryptor(decryptorLibrary, options)
+	require.NoError(t, err)
+	assert.Contains(t, decryptor, decryptorLibrary)
+
+	options.SopsBinary = fakeSops("sops 3.9.4 (latest)")
+	old, err := cacheDecryptor(decryptorBinary, options)
+	require.NoError(t, err)
+	assert.Equal(t, "binary sops 3.9.4", old)
+
+	options.SopsBinary = fakeSops("sops 3.10.0")
+	upgraded, err := cacheDecryptor(decryptorBinary, options)
+	require.NoError(t, err)
+	assert.Equal(t, "binary sops 3.10.0", upgraded)
+}
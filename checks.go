@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultPlaceholderPattern matches values commonly left behind when a secret
+// is blanked out while editing
+const defaultPlaceholderPattern = `(?i)^(changeme|change_me|todo|tbd|fixme|placeholder|redacted|<[^>]*>|x{3,})$`
+
+// defaultEntropyThreshold is the total Shannon entropy of a value, in bits,
+// below which a new value is reported by --entropy-warn. Random base64 or hex
+// secrets of 12 characters or more are above it, while dictionary words with
+// a few digits, such as password123 (about 36 bits), and short repeats are
+// below.
+const defaultEntropyThreshold = 40.0
+
+// nonSecretKeyNames are key names whose values are usually configuration
+// rather than secrets, so a low entropy value is expected
+var nonSecretKeyNames = map[string]bool{
+	"enabled": true, "disabled": true, "debug": true, "env": true, "environment": true,
+	"host": true, "hostname": true, "port": true, "url": true, "uri": true, "endpoint": true,
+	"region": true, "zone": true, "name": true, "username": true, "user": true, "email": true,
+	"path": true, "version": true, "mode": true, "level": true, "timeout": true, "type": true,
+}
+
+// sortedChanges returns changes ordered by key, since they are collected from
+// map iteration
+func sortedChanges(changes []keyChange) []keyChange {
+	sorted := append([]keyChange(nil), changes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
+
+// warnSuspiciousValues runs the checks on the new values of a comparison.
+// runDiff calls it once whatever the output mode, so the warnings show in a
+// full diff as well as in summary mode.
+func warnSuspiciousValues(result DiffResult, options DiffOptions) {
+	changes := result.changes()
+	warnPlaceholderValues(changes, options)
+	if options.EntropyWarn {
+		warnLowEntropyValues(changes, options)
+	}
+}
+
+// warnPlaceholderValues warns about modified keys whose new value is empty or
+// looks like a placeholder. Values are never printed.
+func warnPlaceholderValues(changes []keyChange, options DiffOptions) {
+	var placeholder *regexp.Regexp
+	if options.PlaceholderPattern != "" {
+		placeholder = regexp.MustCompile(options.PlaceholderPattern)
+	}
+
+	for _, change := range sortedChanges(changes) {
+		if change.Kind != changeModified {
+			continue
+		}
+
+		value, ok := change.NewValue.(string)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case value == "":
+			warnf(options, "WARNING: Key '%s' was set to an empty value", change.Key)
+		case placeholder != nil && placeholder.MatchString(value):
+			warnf(options, "WARNING: Key '%s' was set to a placeholder value", change.Key)
+		}
+	}
+}
+
+// warnLowEntropyValues warns about added or modified string values whose
+// entropy is below the threshold, skipping keys that look like plain
+// configuration. This is a best-effort hint, values are never printed.
+func warnLowEntropyValues(changes []keyChange, options DiffOptions) {
+	for _, change := range sortedChanges(changes) {
+		if change.Kind != changeAdded && change.Kind != changeModified {
+			continue
+		}
+
+		// Empty values are already reported for modified keys
+		value, ok := change.NewValue.(string)
+		if !ok || value == "" || looksNonSecret(change.Key, options.PathStyle) {
+			continue
+		}
+
+		if entropy := totalEntropy(value); entropy < options.EntropyThreshold {
+			warnf(options, "WARNING: Key '%s' has a low entropy value (%.0f bits)", change.Key, entropy)
+		}
+	}
+}
+
+// looksNonSecret reports whether the last segment of a key path names a field
+// that usually holds configuration, such as a host or port
+func looksNonSecret(key, style string) bool {
+	segments := splitKeyPath(key, style)
+	name := strings.ToLower(segments[len(segments)-1])
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+
+	if nonSecretKeyNames[name] {
+		return true
+	}
+	// Also match suffixed names such as DB_HOST or redis_port
+	if i := strings.LastIndex(name, "_"); i >= 0 {
+		return nonSecretKeyNames[name[i+1:]]
+	}
+	return false
+}
+
+// shannonEntropy returns the Shannon entropy of a string in bits per character
+func shannonEntropy(value string) float64 {
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range value {
+		counts[r]++
+		total++
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// totalEntropy returns the Shannon entropy of a string over all of its
+// characters, so a short value scores lower than a longer one drawn from the
+// same characters
+func totalEntropy(value string) float64 {
+	return shannonEntropy(value) * float64(utf8.RuneCountInString(value))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The checks run on the comparison itself, so every output mode warns
+func TestSuspiciousValuesWarnInEveryMode(t *testing.T) {
+	modes := map[string]func(*DiffOptions){
+		"full":    func(*DiffOptions) {},
+		"summary": func(options *DiffOptions) { options.SummaryMode = true },
+	}
+
+	for _, ext := range []string{"yaml", "env"} {
+		content1, content2 := "pw: s3cr3t-Xk9#qLm2\ntoken: old\n", "pw: CHANGEME\ntoken: password123\n"
+		if ext == "env" {
+			content1, content2 = "PW=s3cr3t-Xk9#qLm2\nTOKEN=old\n", "PW=CHANGEME\nTOKEN=password123\n"
+		}
+
+		for name, configure := range modes {
+			t.Run(ext+"/"+name, func(t *testing.T) {
+				dir := t.TempDir()
+				path1 := filepath.Join(dir, "a."+ext)
+				path2 := filepath.Join(dir, "b."+ext)
+				require.NoError(t, os.WriteFile(path1, []byte(content1), 0600))
+				require.NoError(t, os.WriteFile(path2, []byte(content2), 0600))
+
+				options := testOptions()
+				options.OutputFile = filepath.Join(dir, "out.txt")
+				options.SummaryOut = filepath.Join(dir, "summary.txt")
+				options.NoKeyCheck = true
+				options.PlaintextReference = path1
+				options.PlaceholderPattern = defaultPlaceholderPattern
+				options.EntropyWarn = true
+				options.EntropyThreshold = defaultEntropyThreshold
+				configure(&options)
+
+				stderr := captureStderr(t, func() {
+					require.NoError(t, runDiff(path1, path2, options))
+				})
+				assert.Contains(t, stderr, "was set to a placeholder value")
+				assert.Contains(t, stderr, "has a low entropy value")
+			})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// colorReset ends any color started by a colorScheme sequence
+const colorReset = "\033[0m"
+
+// colorScheme holds the ANSI escape sequences used to highlight diffs,
+// summaries and conflicts. Removed lines are bold by default, since they may
+// be exposed secrets. Moved lines are dimmed, for --color-moved.
+type colorScheme struct {
+	Added    string
+	Removed  string
+	Modified string
+	Header   string
+	Moved    string
+}
+
+// Supported --palette presets
+const (
+	paletteDefault    = "default"
+	paletteColorblind = "colorblind"
+)
+
+// palettes are the built-in color schemes. The colorblind preset uses blue
+// and orange, which stay distinguishable with red-green color blindness.
+var palettes = map[string]colorScheme{
+	paletteDefault: {
+		Added:    "\033[32m",
+		Removed:  "\033[1;31m",
+		Modified: "\033[33m",
+		Header:   "\033[36m",
+		Moved:    "\033[2;34m",
+	},
+	paletteColorblind: {
+		Added:    "\033[34m",
+		Removed:  "\033[1;38;5;208m",
+		Modified: "\033[35m",
+		Header:   "\033[36m",
+		Moved:    "\033[2m",
+	},
+}
+
+// ansiColorNames maps color names to their ANSI foreground codes
+var ansiColorNames = map[string]int{
+	"black":   30,
+	"red":     31,
+	"green":   32,
+	"yellow":  33,
+	"blue":    34,
+	"magenta": 35,
+	"cyan":    36,
+	"white":   37,
+}
+
+// newColorScheme starts from a palette and overrides the colors given as
+// flags, any of which may be empty
+func newColorScheme(palette, added, removed, modified, header string) (colorScheme, error) {
+	scheme, ok := palettes[palette]
+	if !ok {
+		return colorScheme{}, fmt.Errorf("invalid --palette %q: must be %s or %s", palette, paletteDefault, paletteColorblind)
+	}
+
+	for _, color := range []struct {
+		flag  string
+		spec  string
+		field *string
+	}{
+		{"--color-added", added, &scheme.Added},
+		{"--color-removed", removed, &scheme.Removed},
+		{"--color-modified", modified, &scheme.Modified},
+		{"--color-header", header, &scheme.Header},
+	} {
+		if color.spec == "" {
+			continue
+		}
+		sequence, err := parseColor(color.spec)
+		if err != nil {
+			return colorScheme{}, fmt.Errorf("invalid %s: %w", color.flag, err)
+		}
+		*color.field = sequence
+	}
+
+	return scheme, nil
+}
+
+// parseColor turns a color name (red, bright-blue, bold-red) or a 256-color
+// code (0-255) into an ANSI escape sequence
+func parseColor(spec string) (string, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+
+	if code, err := strconv.Atoi(spec); err == nil {
+		if code < 0 || code > 255 {
+			return "", fmt.Errorf("256-color code %d out of range 0-255", code)
+		}
+		return fmt.Sprintf("\033[38;5;%dm", code), nil
+	}
+
+	bold := false
+	if name, ok := strings.CutPrefix(spec, "bold-"); ok {
+		bold = true
+		spec = name
+	}
+
+	offset := 0
+	if name, ok := strings.CutPrefix(spec, "bright-"); ok {
+		offset = 60
+		spec = name
+	}
+
+	code, ok := ansiColorNames[spec]
+	if !ok {
+		return "", fmt.Errorf("unknown color %q: use a name such as red or bright-blue, or a code from 0 to 255", spec)
+	}
+	if bold {
+		return fmt.Sprintf("\033[1;%dm", code+offset), nil
+	}
+	return fmt.Sprintf("\033[%dm", code+offset), nil
+}
+
+// Supported --color modes
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// colorFlag is the value of --color. Besides auto, always and never it accepts
+// true and false, the values of the original boolean flag, as auto and never.
+type colorFlag string
+
+func (c *colorFlag) String() string {
+	return string(*c)
+}
+
+func (c *colorFlag) Set(value string) error {
+	switch strings.ToLower(value) {
+	case colorAuto, "true":
+		*c = colorAuto
+	case colorAlways:
+		*c = colorAlways
+	case colorNever, "false":
+		*c = colorNever
+	default:
+		return fmt.Errorf("must be auto, always or never")
+	}
+	return nil
+}
+
+func (c *colorFlag) Type() string {
+	return "when"
+}
+
+// useColor reports whether output should be colored: never with
+// --color=never or when NO_COLOR (https://no-color.org) is set, always with
+// --color=always, and otherwise only when stdout is a terminal
+func useColor(options DiffOptions) bool {
+	return colorEnabled(options, os.Stdout)
+}
+
+// colorEnabled applies the useColor rules to the given output file
+func colorEnabled(options DiffOptions, output *os.File) bool {
+	if !options.ColorOutput || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if options.ForceColor {
+		return true
+	}
+	return isatty.IsTerminal(output.Fd())
+}
+
+// warnf prints a warning or note line to stderr, in the modified color of
+// the scheme when stderr gets colors
+func warnf(options DiffOptions, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if options.Colors.Modified != "" && colorEnabled(options, os.Stderr) {
+		message = options.Colors.Modified + message + colorReset
+	}
+	fmt.Fprintln(os.Stderr, message)
+}
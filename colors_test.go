@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarnfFollowsColorSettings(t *testing.T) {
+	scheme, err := newColorScheme(paletteColorblind, "", "", "", "")
+	require.NoError(t, err)
+
+	options := testOptions()
+	options.Colors = scheme
+	options.ColorOutput = true
+	options.ForceColor = true
+	assert.Equal(t, "\033[35mWARNING: Key 'pw' was set to an empty value\033[0m\n",
+		captureStderr(t, func() { warnf(options, "WARNING: Key '%s' was set to an empty value", "pw") }))
+
+	t.Setenv("NO_COLOR", "1")
+	assert.Equal(t, "WARNING: x\n", captureStderr(t, func() { warnf(options, "WARNING: x") }))
+	t.Setenv("NO_COLOR", "")
+
+	// --color=never
+	options.ColorOutput = false
+	options.ForceColor = false
+	assert.Equal(t, "WARNING: x\n", captureStderr(t, func() { warnf(options, "WARNING: x") }))
+
+	// Auto colors stderr only when it is a terminal, which a pipe is not
+	options.ColorOutput = true
+	assert.Equal(t, "WARNING: x\n", captureStderr(t, func() { warnf(options, "WARNING: x") }))
+}
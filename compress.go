@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// gzipMagic is the header every gzip stream starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressInput transparently decompresses gzip-compressed input, detected by
+// its magic header rather than the file name; other content is returned as is.
+// Decompression stops once the output exceeds maxSize bytes.
+func decompressInput(content []byte, maxSize int64) ([]byte, error) {
+	if !bytes.HasPrefix(content, gzipMagic) {
+		return content, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing gzip data: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := readAllLimited(reader, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing gzip data: %w", err)
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/decrypt"
+	"github.com/getsops/sops/v3/pgp"
+	"gopkg.in/yaml.v3"
+)
+
+// Decryption backends selectable with --decryptor. With auto, PGP files are
+// decrypted with the sops binary and everything else with the library.
+const (
+	decryptorAuto    = "auto"
+	decryptorLibrary = "library"
+	decryptorBinary  = "binary"
+)
+
+// checkDecryptor validates the --decryptor flag
+func checkDecryptor(name string) error {
+	if name != decryptorAuto && name != decryptorLibrary && name != decryptorBinary {
+		return fmt.Errorf("invalid --decryptor %q: must be auto, library or binary", name)
+	}
+	return nil
+}
+
+// hasPGPKey reports whether the sops metadata of the content lists a PGP
+// recipient. Content that does not load as an encrypted file has none.
+func hasPGPKey(content []byte, format string) bool {
+	store := common.StoreForFormat(formats.FormatFromString(format), config.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(content)
+	if err != nil {
+		return false
+	}
+
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			if key.TypeToIdentifier() == pgp.KeyTypeIdentifier {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveDecryptor picks the backend for one file. Under --decryptor=auto,
+// files with a PGP recipient go to the sops binary when it is installed, so
+// its gpg-agent integration applies: the library does not start or ask the
+// agent the way the sops command does, and prompts or fails instead.
+func resolveDecryptor(content []byte, format string, options DiffOptions) string {
+	if options.Decryptor != decryptorAuto && options.Decryptor != "" {
+		return options.Decryptor
+	}
+	if !hasPGPKey(content, format) {
+		return decryptorLibrary
+	}
+
+	if _, err := lookupSopsBinary(options); err != nil {
+		if options.Verbose {
+			fmt.Fprintf(os.Stderr, "File is encrypted with PGP but %v; decrypting with the SOPS library\n", err)
+		}
+		return decryptorLibrary
+	}
+	if options.Verbose {
+		fmt.Fprintln(os.Stderr, "File is encrypted with PGP; decrypting with the sops binary for gpg-agent support")
+	}
+	return decryptorBinary
+}
+
+// kmsAccessErrors are fragments of AWS error messages that indicate the
+// caller is not allowed to use the KMS key, as opposed to a transient failure
+var kmsAccessErrors = []string{
+	"AccessDeniedException",
+	"is not authorized to perform",
+	"UnrecognizedClientException",
+	"ExpiredToken",
+	"InvalidClientTokenId",
+	"failed to refresh cached credentials",
+}
+
+// isMetadataNotFound reports whether decryption failed because the content has
+// no SOPS metadata, i.e. the file is not encrypted. The SOPS stores return the
+// exported sops.MetadataNotFound value unwrapped, so this relies on the upstream
+// error value rather than its wording.
+func isMetadataNotFound(err error) bool {
+	return errors.Is(err, sops.MetadataNotFound)
+}
+
+// plainDocumentError turns the decryption error for a plaintext document the
+// SOPS stores cannot load into sops.MetadataNotFound, so it is handled like
+// other unencrypted files. This covers XML, NDJSON, plist and binary files,
+// which are decrypted with the binary store, and JSON or YAML documents that
+// are a bare array or scalar. SOPS only writes mappings in these formats, so they can never be
+// encrypted files. An env file without any sops_ key can't be one either.
+func plainDocumentError(content []byte, format string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	switch format {
+	case "xml":
+		if bytes.HasPrefix(trimmed, []byte("<")) {
+			return sops.MetadataNotFound
+		}
+	case "ndjson":
+		if isNDJSON(trimmed) {
+			return sops.MetadataNotFound
+		}
+	case "binary":
+		if !isBinaryStoreFile(trimmed) {
+			return sops.MetadataNotFound
+		}
+	case "plist":
+		if isBinaryPlist(content) || isXMLPlist(trimmed) {
+			return sops.MetadataNotFound
+		}
+	case "json":
+		if json.Valid(trimmed) && !bytes.HasPrefix(trimmed, []byte("{")) {
+			return sops.MetadataNotFound
+		}
+	case "env":
+		env, _, _ := parseEnv(trimmed)
+		for _, key := range env.Keys {
+			if strings.HasPrefix(key, "sops_") {
+				return err
+			}
+		}
+		return sops.MetadataNotFound
+	case "yaml":
+		var document interface{}
+		if yaml.Unmarshal(trimmed, &document) == nil {
+			switch document.(type) {
+			case map[string]interface{}, nil:
+			default:
+				return sops.MetadataNotFound
+			}
+		}
+	}
+
+	return err
+}
+
+// isBlankDocument reports whether content is empty or only whitespace
+func isBlankDocument(content []byte) bool {
+	return len(bytes.TrimSpace(content)) == 0
+}
+
+// looksEncrypted reports whether content holds SOPS-encrypted values, which
+// every store writes as ENC[AES256_GCM,...] whatever the file format
+func looksEncrypted(content []byte) bool {
+	return bytes.Contains(content, []byte("ENC[AES256_GCM,"))
+}
+
+// isBinaryStoreFile reports whether content was written by the SOPS binary
+// store: a JSON document holding only the encrypted "data" string and the
+// "sops" metadata. The metadata doesn't record the input type, so this shape
+// is the only sign of it.
+func isBinaryStoreFile(content []byte) bool {
+	trimmed := bytes.TrimSpace(content)
+	if !bytes.HasPrefix(trimmed, []byte("{")) || !looksEncrypted(trimmed) {
+		return false
+	}
+
+	var document map[string]interface{}
+	if json.Unmarshal(trimmed, &document) != nil || len(document) != 2 {
+		return false
+	}
+	data, isString := document["data"].(string)
+	_, hasMetadata := document["sops"].(map[string]interface{})
+	return isString && hasMetadata && strings.HasPrefix(data, "ENC[AES256_GCM,")
+}
+
+// checkStoreFormat fails early when a file SOPS encrypted as binary is about
+// to be decrypted as YAML, which would compare a single opaque "data" key.
+// Files whose format is sniffed are detected as binary instead, and a json
+// format is trusted, since a JSON file whose only key is an encrypted "data"
+// string looks the same.
+func checkStoreFormat(path string, content []byte, format string) error {
+	if format != "yaml" || !isBinaryStoreFile(content) {
+		return nil
+	}
+	return &BinaryStoreError{Path: path, Format: format}
+}
+
+// applyKeyProviderEnv exports the key provider flags as the environment
+// variables the SOPS library reads, so they apply to both files
+func applyKeyProviderEnv(options DiffOptions) error {
+	if options.AgeKeyFile != "" {
+		if _, err := os.Stat(options.AgeKeyFile); err != nil {
+			return fmt.Errorf("error reading age key file: %w", err)
+		}
+	}
+
+	// Values are never logged, the age key is secret material
+	vars := map[string]string{
+		"AWS_PROFILE":       options.AWSProfile,
+		"AWS_REGION":        options.AWSRegion,
+		"SOPS_AGE_KEY_FILE": options.AgeKeyFile,
+		"SOPS_AGE_KEY":      options.AgeKey,
+	}
+
+	for name, value := range vars {
+		if value == "" {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return fmt.Errorf("error setting %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// explainDecryptError replaces the generic "Error getting data key" message
+// with an actionable one when AWS KMS rejected the request
+func explainDecryptError(err error, options DiffOptions) error {
+	var userErr sops.UserError
+	if !errors.As(err, &userErr) {
+		return err
+	}
+
+	details := userErr.UserError()
+	for _, fragment := range kmsAccessErrors {
+		if strings.Contains(details, fragment) {
+			profile := options.AWSProfile
+			if profile == "" {
+				profile = os.Getenv("AWS_PROFILE")
+			}
+			region := options.AWSRegion
+			if region == "" {
+				region = os.Getenv("AWS_REGION")
+			}
+			return fmt.Errorf("AWS KMS denied access to the data key (profile %q, region %q); "+
+				"check --aws-profile/--aws-region and the key policy: %w", profile, region, err)
+		}
+	}
+
+	return err
+}
+
+// decryptBytes decrypts SOPS content in the given format, consulting the
+// decryption cache first when it is enabled. Every command decrypts through
+// it, with the SOPS library or the sops binary as chosen by --decryptor.
+// Under --offline, network key providers are never contacted, and transient
+// errors are retried up to --retries times.
+func decryptBytes(content []byte, format string, options DiffOptions) ([]byte, error) {
+	backend := resolveDecryptor(content, format, options)
+
+	var cache *decryptionCache
+	if options.Cache {
+		decryptor, err := cacheDecryptor(backend, options)
+		if err != nil {
+			return nil, err
+		}
+		cache, err = newDecryptionCache(options.CacheDir, decryptor)
+		if err != nil {
+			return nil, err
+		}
+
+		if plaintext, ok := cache.get(content, format); ok {
+			return plaintext, nil
+		}
+	}
+
+	encrypted := content
+	if options.Offline {
+		var err error
+		encrypted, err = offlineContent(content, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err := withDecryptRetries(options, func() ([]byte, error) {
+		if backend == decryptorBinary {
+			return decryptWithSopsBinary(encrypted, format, options)
+		}
+		return decrypt.Data(encrypted, format)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if err := cache.put(content, format, plaintext); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	return plaintext, nil
+}
+
+// decryptWithSopsBinary decrypts SOPS content with the sops command line,
+// for --decryptor=binary. Only the ciphertext is written to a temporary file,
+// the plaintext is read from the command's output.
+func decryptWithSopsBinary(content []byte, format string, options DiffOptions) ([]byte, error) {
+	sopsBin, err := lookupSopsBinary(options)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := os.CreateTemp("", "sops-diff-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(input.Name())
+
+	_, err = input.Write(content)
+	if closeErr := input.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if format == "" {
+		format = "binary"
+	}
+	cmd := exec.Command(sopsBin, "-d", "--input-type", format, "--output-type", format, input.Name())
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// Report plaintext files like the library does
+			if strings.Contains(string(exitErr.Stderr), "sops metadata not found") {
+				return nil, sops.MetadataNotFound
+			}
+			return nil, &sopsBinaryError{Stderr: strings.TrimSpace(string(exitErr.Stderr))}
+		}
+		return nil, fmt.Errorf("sops decryption failed: %w", err)
+	}
+
+	return output, nil
+}
+
+// decryptPair decrypts both contents in parallel, each in its own format.
+// Results and errors are returned per file so callers can report them in a
+// deterministic order.
+func decryptPair(content1, content2 []byte, format1, format2 string, options DiffOptions) ([]byte, []byte, error, error) {
+	var decrypted1, decrypted2 []byte
+	var err1, err2 error
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		decrypted1, err1 = decryptBytes(content1, format1, options)
+	}()
+	go func() {
+		defer wg.Done()
+		decrypted2, err2 = decryptBytes(content2, format2, options)
+	}()
+	wg.Wait()
+
+	return decrypted1, decrypted2, err1, err2
+}
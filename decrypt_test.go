@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These go through the SOPS library, so an upgrade that stops returning
+// sops.MetadataNotFound for plaintext fails here instead of decrypted files
+// being reported as decryption errors
+func TestDecryptBytesReportsPlaintextAsMetadataNotFound(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+	}{
+		{"yaml", "db:\n  password: secret\n"},
+		{"json", "{\"db\": {\"password\": \"secret\"}}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			_, err := decryptBytes([]byte(tt.content), tt.format, testOptions())
+			require.Error(t, err)
+			assert.True(t, isMetadataNotFound(err), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestIsMetadataNotFoundOnlyMatchesMissingMetadata(t *testing.T) {
+	assert.False(t, isMetadataNotFound(nil))
+	assert.False(t, isMetadataNotFound(errors.New("sops metadata not found")))
+}
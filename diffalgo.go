@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Supported --diff-algorithm values. myers is the go-difflib matcher used so
+// far; patience and histogram anchor the diff on lines that occur rarely, so
+// moved blocks and reordered sections produce fewer, cleaner hunks.
+const (
+	diffAlgorithmMyers     = "myers"
+	diffAlgorithmPatience  = "patience"
+	diffAlgorithmHistogram = "histogram"
+)
+
+// lineMatcher finds the matching blocks between a[alo:ahi] and b[blo:bhi],
+// in order
+type lineMatcher func(a, b []string, alo, ahi, blo, bhi int) []difflib.Match
+
+// unifiedDiff renders diff with the given algorithm, in the same format as
+// difflib.GetUnifiedDiffString. With ignoreWhitespace, lines that differ only
+// in whitespace are treated as unchanged, and shown as in diff.A.
+func unifiedDiff(diff difflib.UnifiedDiff, algorithm string, ignoreWhitespace bool) string {
+	var matcher lineMatcher
+	switch algorithm {
+	case diffAlgorithmPatience:
+		matcher = patienceMatches
+	case diffAlgorithmHistogram:
+		matcher = histogramMatches
+	default:
+		if !ignoreWhitespace {
+			result, _ := difflib.GetUnifiedDiffString(diff)
+			return result
+		}
+		matcher = difflibMatches
+	}
+
+	// Lines are matched by their comparison form but rendered as they are
+	a, b := diff.A, diff.B
+	if ignoreWhitespace {
+		a, b = withoutWhitespace(a), withoutWhitespace(b)
+	}
+
+	matches := mergeMatches(matcher(a, b, 0, len(a), 0, len(b)))
+	groups := groupOpCodes(matchOpCodes(matches, len(diff.A), len(diff.B)), diff.Context)
+	if len(groups) == 0 {
+		return ""
+	}
+
+	var buffer strings.Builder
+	if diff.FromFile != "" || diff.ToFile != "" {
+		buffer.WriteString("--- " + diff.FromFile + diff.Eol)
+		buffer.WriteString("+++ " + diff.ToFile + diff.Eol)
+	}
+	for _, group := range groups {
+		first, last := group[0], group[len(group)-1]
+		fmt.Fprintf(&buffer, "@@ -%s +%s @@%s", unifiedRange(first.I1, last.I2), unifiedRange(first.J1, last.J2), diff.Eol)
+
+		for _, code := range group {
+			if code.Tag == 'e' {
+				for _, line := range diff.A[code.I1:code.I2] {
+					buffer.WriteString(" " + line)
+				}
+				continue
+			}
+			if code.Tag == 'r' || code.Tag == 'd' {
+				for _, line := range diff.A[code.I1:code.I2] {
+					buffer.WriteString("-" + line)
+				}
+			}
+			if code.Tag == 'r' || code.Tag == 'i' {
+				for _, line := range diff.B[code.J1:code.J2] {
+					buffer.WriteString("+" + line)
+				}
+			}
+		}
+	}
+	return buffer.String()
+}
+
+// withoutWhitespace returns lines with all their whitespace removed, like
+// diff -w compares them
+func withoutWhitespace(lines []string) []string {
+	stripped := make([]string, len(lines))
+	for i, line := range lines {
+		stripped[i] = strings.Join(strings.Fields(line), "")
+	}
+	return stripped
+}
+
+// unifiedRange formats a hunk range like difflib: a single line is just its
+// number, and an empty range starts at the line before it
+func unifiedRange(start, stop int) string {
+	beginning, length := start+1, stop-start
+	if length == 1 {
+		return fmt.Sprintf("%d", beginning)
+	}
+	if length == 0 {
+		beginning--
+	}
+	return fmt.Sprintf("%d,%d", beginning, length)
+}
+
+// matchTrimmed matches the common prefix and suffix of both ranges directly
+// and leaves the rest to inner
+func matchTrimmed(a, b []string, alo, ahi, blo, bhi int, inner lineMatcher) []difflib.Match {
+	var matches []difflib.Match
+
+	prefix := 0
+	for alo+prefix < ahi && blo+prefix < bhi && a[alo+prefix] == b[blo+prefix] {
+		prefix++
+	}
+	if prefix > 0 {
+		matches = append(matches, difflib.Match{A: alo, B: blo, Size: prefix})
+		alo, blo = alo+prefix, blo+prefix
+	}
+
+	suffix := 0
+	for alo < ahi-suffix && blo < bhi-suffix && a[ahi-suffix-1] == b[bhi-suffix-1] {
+		suffix++
+	}
+	ahi, bhi = ahi-suffix, bhi-suffix
+
+	if alo < ahi && blo < bhi {
+		matches = append(matches, inner(a, b, alo, ahi, blo, bhi)...)
+	}
+	if suffix > 0 {
+		matches = append(matches, difflib.Match{A: ahi, B: bhi, Size: suffix})
+	}
+	return matches
+}
+
+// patienceMatches implements patience diff: lines that occur exactly once on
+// each side are matched in their longest increasing order, and the ranges
+// between them are diffed recursively. A range without unique lines falls
+// back to the difflib matcher.
+func patienceMatches(a, b []string, alo, ahi, blo, bhi int) []difflib.Match {
+	return matchTrimmed(a, b, alo, ahi, blo, bhi, func(a, b []string, alo, ahi, blo, bhi int) []difflib.Match {
+		anchors := uniqueAnchors(a, b, alo, ahi, blo, bhi)
+		if len(anchors) == 0 {
+			return difflibMatches(a, b, alo, ahi, blo, bhi)
+		}
+
+		var matches []difflib.Match
+		i, j := alo, blo
+		for _, anchor := range anchors {
+			matches = append(matches, patienceMatches(a, b, i, anchor.A, j, anchor.B)...)
+			matches = append(matches, anchor)
+			i, j = anchor.A+1, anchor.B+1
+		}
+		return append(matches, patienceMatches(a, b, i, ahi, j, bhi)...)
+	})
+}
+
+// uniqueAnchors returns the lines occurring exactly once in both ranges that
+// form the longest sequence in the same order on both sides
+func uniqueAnchors(a, b []string, alo, ahi, blo, bhi int) []difflib.Match {
+	type occurrence struct {
+		countA, countB int
+		i, j           int
+	}
+	lines := make(map[string]*occurrence)
+	for i := alo; i < ahi; i++ {
+		o, ok := lines[a[i]]
+		if !ok {
+			o = &occurrence{}
+			lines[a[i]] = o
+		}
+		o.countA++
+		o.i = i
+	}
+	for j := blo; j < bhi; j++ {
+		if o, ok := lines[b[j]]; ok {
+			o.countB++
+			o.j = j
+		}
+	}
+
+	// Unique pairs in the order of a
+	var pairs []difflib.Match
+	for i := alo; i < ahi; i++ {
+		if o := lines[a[i]]; o.countA == 1 && o.countB == 1 {
+			pairs = append(pairs, difflib.Match{A: o.i, B: o.j, Size: 1})
+		}
+	}
+
+	// Longest increasing subsequence by position in b, by patience sorting
+	var tails []int
+	previous := make([]int, len(pairs))
+	for k, pair := range pairs {
+		lo, hi := 0, len(tails)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if pairs[tails[mid]].B < pair.B {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		previous[k] = -1
+		if lo > 0 {
+			previous[k] = tails[lo-1]
+		}
+		if lo == len(tails) {
+			tails = append(tails, k)
+		} else {
+			tails[lo] = k
+		}
+	}
+
+	if len(tails) == 0 {
+		return nil
+	}
+	anchors := make([]difflib.Match, len(tails))
+	for k, n := tails[len(tails)-1], len(tails)-1; k >= 0; k, n = previous[k], n-1 {
+		anchors[n] = pairs[k]
+	}
+	return anchors
+}
+
+// histogramMaxOccurrences caps how often a line may occur in a to be used as
+// an anchor, like git's histogram diff. Ranges where every common line is
+// more frequent fall back to the difflib matcher.
+const histogramMaxOccurrences = 64
+
+// histogramMatches implements histogram diff: the longest common run around
+// the lines occurring least often in a is matched, and the ranges around it
+// are diffed recursively. The lines of a are indexed by content, so each
+// line of b only visits its own occurrences.
+func histogramMatches(a, b []string, alo, ahi, blo, bhi int) []difflib.Match {
+	return matchTrimmed(a, b, alo, ahi, blo, bhi, func(a, b []string, alo, ahi, blo, bhi int) []difflib.Match {
+		occurrences := make(map[string][]int)
+		for i := alo; i < ahi; i++ {
+			occurrences[a[i]] = append(occurrences[a[i]], i)
+		}
+
+		var best difflib.Match
+		bestCount := histogramMaxOccurrences + 1
+		for j := blo; j < bhi; {
+			next := j + 1
+			positions := occurrences[b[j]]
+			count := len(positions)
+			if count == 0 || count > bestCount {
+				j = next
+				continue
+			}
+
+			for _, i := range positions {
+				start := 0
+				for i-start > alo && j-start > blo && a[i-start-1] == b[j-start-1] {
+					start++
+				}
+				end := 1
+				for i+end < ahi && j+end < bhi && a[i+end] == b[j+end] {
+					end++
+				}
+
+				if count < bestCount || start+end > best.Size {
+					best = difflib.Match{A: i - start, B: j - start, Size: start + end}
+					bestCount = count
+				}
+				// The lines of b inside this run were compared already
+				next = max(next, j+end)
+			}
+			j = next
+		}
+
+		if best.Size == 0 {
+			return difflibMatches(a, b, alo, ahi, blo, bhi)
+		}
+
+		matches := histogramMatches(a, b, alo, best.A, blo, best.B)
+		matches = append(matches, best)
+		return append(matches, histogramMatches(a, b, best.A+best.Size, ahi, best.B+best.Size, bhi)...)
+	})
+}
+
+// difflibMatches returns the matching blocks difflib finds within the ranges
+func difflibMatches(a, b []string, alo, ahi, blo, bhi int) []difflib.Match {
+	var matches []difflib.Match
+	for _, match := range difflib.NewMatcher(a[alo:ahi], b[blo:bhi]).GetMatchingBlocks() {
+		if match.Size > 0 {
+			matches = append(matches, difflib.Match{A: alo + match.A, B: blo + match.B, Size: match.Size})
+		}
+	}
+	return matches
+}
+
+// mergeMatches joins matching blocks that directly follow each other
+func mergeMatches(matches []difflib.Match) []difflib.Match {
+	var merged []difflib.Match
+	for _, match := range matches {
+		if n := len(merged); n > 0 && merged[n-1].A+merged[n-1].Size == match.A && merged[n-1].B+merged[n-1].Size == match.B {
+			merged[n-1].Size += match.Size
+			continue
+		}
+		merged = append(merged, match)
+	}
+	return merged
+}
+
+// matchOpCodes turns ordered matching blocks into difflib opcodes describing
+// how to turn a into b
+func matchOpCodes(matches []difflib.Match, lenA, lenB int) []difflib.OpCode {
+	var codes []difflib.OpCode
+	i, j := 0, 0
+	for _, match := range append(matches, difflib.Match{A: lenA, B: lenB}) {
+		switch {
+		case i < match.A && j < match.B:
+			codes = append(codes, difflib.OpCode{Tag: 'r', I1: i, I2: match.A, J1: j, J2: match.B})
+		case i < match.A:
+			codes = append(codes, difflib.OpCode{Tag: 'd', I1: i, I2: match.A, J1: j, J2: match.B})
+		case j < match.B:
+			codes = append(codes, difflib.OpCode{Tag: 'i', I1: i, I2: match.A, J1: j, J2: match.B})
+		}
+		if match.Size > 0 {
+			codes = append(codes, difflib.OpCode{Tag: 'e', I1: match.A, I2: match.A + match.Size, J1: match.B, J2: match.B + match.Size})
+		}
+		i, j = match.A+match.Size, match.B+match.Size
+	}
+	return codes
+}
+
+// groupOpCodes splits opcodes into hunks with up to n lines of context, the
+// way difflib's GetGroupedOpCodes does
+func groupOpCodes(codes []difflib.OpCode, n int) [][]difflib.OpCode {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	if first := codes[0]; first.Tag == 'e' {
+		codes[0] = difflib.OpCode{Tag: 'e', I1: max(first.I1, first.I2-n), I2: first.I2, J1: max(first.J1, first.J2-n), J2: first.J2}
+	}
+	if last := codes[len(codes)-1]; last.Tag == 'e' {
+		codes[len(codes)-1] = difflib.OpCode{Tag: 'e', I1: last.I1, I2: min(last.I2, last.I1+n), J1: last.J1, J2: min(last.J2, last.J1+n)}
+	}
+
+	var groups [][]difflib.OpCode
+	var group []difflib.OpCode
+	for _, code := range codes {
+		i1, j1 := code.I1, code.J1
+
+		// A long unchanged range ends the current hunk and starts the next
+		if code.Tag == 'e' && code.I2-code.I1 > 2*n {
+			group = append(group, difflib.OpCode{Tag: 'e', I1: i1, I2: min(code.I2, i1+n), J1: j1, J2: min(code.J2, j1+n)})
+			groups = append(groups, group)
+			group = nil
+			i1, j1 = max(i1, code.I2-n), max(j1, code.J2-n)
+		}
+		group = append(group, difflib.OpCode{Tag: code.Tag, I1: i1, I2: code.I2, J1: j1, J2: code.J2})
+	}
+	if len(group) > 0 && !(len(group) == 1 && group[0].Tag == 'e') {
+		groups = append(groups, group)
+	}
+	return groups
+}
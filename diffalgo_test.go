@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// configLines builds a YAML-like document of n lines with many repeated
+// lines, as real configuration files have
+func configLines(n int, seed int64) []string {
+	random := rand.New(rand.NewSource(seed))
+	lines := make([]string, n)
+	for i := range lines {
+		switch i % 4 {
+		case 0:
+			lines[i] = fmt.Sprintf("service%d:\n", i/4)
+		case 1:
+			lines[i] = "  enabled: true\n"
+		case 2:
+			lines[i] = fmt.Sprintf("  port: %d\n", 1000+random.Intn(50))
+		default:
+			lines[i] = fmt.Sprintf("  token: %x\n", random.Int63())
+		}
+	}
+	return lines
+}
+
+// editLines changes, removes and inserts some lines
+func editLines(lines []string, seed int64) []string {
+	random := rand.New(rand.NewSource(seed))
+	var edited []string
+	for _, line := range lines {
+		switch random.Intn(20) {
+		case 0:
+			continue
+		case 1:
+			edited = append(edited, fmt.Sprintf("  added: %d\n", random.Int()))
+		case 2:
+			line = "  enabled: false\n"
+		}
+		edited = append(edited, line)
+	}
+	return edited
+}
+
+// checkMatches verifies that matches are ordered, in range and only pair
+// equal lines
+func checkMatches(t *testing.T, a, b []string, matches []difflib.Match) {
+	t.Helper()
+	i, j := 0, 0
+	for _, match := range matches {
+		require.GreaterOrEqual(t, match.A, i)
+		require.GreaterOrEqual(t, match.B, j)
+		require.LessOrEqual(t, match.A+match.Size, len(a))
+		require.LessOrEqual(t, match.B+match.Size, len(b))
+		for k := 0; k < match.Size; k++ {
+			require.Equal(t, a[match.A+k], b[match.B+k])
+		}
+		i, j = match.A+match.Size, match.B+match.Size
+	}
+}
+
+func TestLineMatchersPairEqualLines(t *testing.T) {
+	for name, matcher := range map[string]lineMatcher{
+		diffAlgorithmPatience:  patienceMatches,
+		diffAlgorithmHistogram: histogramMatches,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for seed := int64(0); seed < 20; seed++ {
+				a := configLines(400, seed)
+				b := editLines(a, seed)
+				checkMatches(t, a, b, matcher(a, b, 0, len(a), 0, len(b)))
+			}
+		})
+	}
+}
+
+func TestHistogramFallsBackForFrequentLines(t *testing.T) {
+	// Every common line occurs more often than histogramMaxOccurrences
+	a := strings.SplitAfter(strings.Repeat("}\n", 100), "\n")
+	b := append([]string{"x\n"}, a[:50]...)
+	matches := histogramMatches(a, b, 0, len(a), 0, len(b))
+	checkMatches(t, a, b, matches)
+	assert.NotEmpty(t, matches)
+}
+
+func BenchmarkHistogramMatches(b *testing.B) {
+	lines1 := configLines(20000, 1)
+	lines2 := editLines(lines1, 2)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		histogramMatches(lines1, lines2, 0, len(lines1), 0, len(lines2))
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// directoryFileExtensions are the file types considered when comparing
+// directories, other files are skipped rather than failing to decrypt
+var directoryFileExtensions = map[string]bool{
+	".json":   true,
+	".yaml":   true,
+	".yml":    true,
+	".env":    true,
+	".xml":    true,
+	".ndjson": true,
+	".jsonl":  true,
+	".plist":  true,
+}
+
+// isDirectory reports whether a path is an existing local directory
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// diffDirectories compares every supported file found in two directories,
+// matched by their relative path. Files ignored by Git or matching an
+// --exclude pattern are skipped.
+func diffDirectories(dir1, dir2 string, options DiffOptions) error {
+	if options.Reverse {
+		dir1, dir2 = dir2, dir1
+		options.Reverse = false
+	}
+
+	files1, err := directoryFiles(dir1, options)
+	if err != nil {
+		return err
+	}
+	files2, err := directoryFiles(dir2, options)
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]bool)
+	for path := range files1 {
+		paths[path] = true
+	}
+	for path := range files2 {
+		paths[path] = true
+	}
+
+	// Each file is printed as it is compared, a pager per file would block
+	options.NoPager = true
+
+	failed := 0
+	for _, path := range sortedKeySet(paths) {
+		// With --numstat, stdout only holds count lines for scripts
+		notes := os.Stdout
+		if options.NumStat {
+			notes = os.Stderr
+		}
+
+		switch {
+		case options.NameOnly && (!files1[path] || !files2[path]):
+			fmt.Println(path)
+			continue
+		case !files1[path]:
+			fmt.Fprintf(notes, "Only in %s: %s\n", dir2, path)
+			continue
+		case !files2[path]:
+			fmt.Fprintf(notes, "Only in %s: %s\n", dir1, path)
+			continue
+		}
+
+		file1Path := filepath.Join(dir1, path)
+		file2Path := filepath.Join(dir2, path)
+
+		// Identical files have no changes, skip decrypting them. Files over
+		// --max-file-size are not read here, runDiff reports them.
+		if checkFileSize(file1Path, options.MaxFileSize) == nil && checkFileSize(file2Path, options.MaxFileSize) == nil {
+			content1, err1 := os.ReadFile(file1Path)
+			content2, err2 := os.ReadFile(file2Path)
+			if err1 == nil && err2 == nil && bytes.Equal(content1, content2) {
+				continue
+			}
+		}
+
+		if !options.NumStat && !options.NameOnly {
+			fmt.Printf("=== %s ===\n", path)
+		}
+
+		fileOptions := options
+		if options.NameOnly {
+			fileOptions.NameOnlyPath = path
+		}
+		if err := runDiff(file1Path, file2Path, fileOptions); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be compared", failed)
+	}
+	return nil
+}
+
+// directoryFiles returns the slash-separated relative paths of the supported
+// files in a directory, leaving out excluded and Git-ignored files
+func directoryFiles(dir string, options DiffOptions) (map[string]bool, error) {
+	var candidates []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if rel != "." && isExcluded(rel, options.Exclude) {
+				logSkipped(options, rel, "excluded")
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case !entry.Type().IsRegular():
+		case isExcluded(rel, options.Exclude):
+			logSkipped(options, rel, "excluded")
+		case !isSupportedFile(rel, options):
+			logSkipped(options, rel, "unsupported file type")
+		default:
+			candidates = append(candidates, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+
+	ignored, err := gitIgnoredPaths(dir, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]bool)
+	for _, path := range candidates {
+		if ignored[path] {
+			logSkipped(options, path, "ignored by .gitignore")
+			continue
+		}
+		files[path] = true
+	}
+	return files, nil
+}
+
+// isSupportedFile reports whether a file has a known extension or one mapped
+// with --ext-map, ignoring a trailing .gz
+func isSupportedFile(path string, options DiffOptions) bool {
+	ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(path, ".gz")))
+	_, mapped := options.ExtensionFormats[ext]
+	return directoryFileExtensions[ext] || mapped
+}
+
+// isExcluded reports whether a relative path, or its base name, matches one
+// of the --exclude glob patterns
+func isExcluded(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// gitIgnoredPaths asks Git which of the relative paths are ignored in dir.
+// Directories outside a Git work tree have nothing ignored.
+func gitIgnoredPaths(dir string, paths []string) (map[string]bool, error) {
+	ignored := make(map[string]bool)
+	if len(paths) == 0 {
+		return ignored, nil
+	}
+
+	cmd := exec.Command("git", "-C", dir, "check-ignore", "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		// Exit status 1 means no path is ignored and 128 that dir is not in a
+		// work tree. Without git there is no .gitignore to respect either.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 128) {
+			return ignored, nil
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return ignored, nil
+		}
+		return nil, fmt.Errorf("error checking .gitignore in %s: %w", dir, err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			ignored[line] = true
+		}
+	}
+	return ignored, nil
+}
+
+// logSkipped reports a skipped file on stderr with --verbose
+func logSkipped(options DiffOptions, path, reason string) {
+	if options.Verbose {
+		fmt.Fprintf(os.Stderr, "Skipping %s (%s)\n", path, reason)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// selectYAMLDocument returns the document at index, counted from 0, of a
+// multi-document YAML stream, for --doc. Blank content is returned unchanged
+// and compared as an empty document like everywhere else.
+func selectYAMLDocument(content []byte, index int) ([]byte, error) {
+	if isBlankDocument(content) {
+		return content, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	count := 0
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if count == index {
+			return yaml.Marshal(&node)
+		}
+		count++
+	}
+
+	return nil, fmt.Errorf("--doc %d is out of range: the file has %d document(s)", index, count)
+}
+
+// countYAMLDocuments returns the number of documents in a YAML stream, or 0
+// when it does not parse
+func countYAMLDocuments(content []byte) int {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	count := 0
+	for {
+		var node yaml.Node
+		if err := decoder.Decode(&node); err != nil {
+			return count
+		}
+		count++
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+	"gopkg.in/yaml.v3"
+)
+
+// duplicateKey is a key defined more than once in the same mapping
+type duplicateKey struct {
+	Key  string
+	Line int
+}
+
+// reportDuplicates prints a warning for every duplicate key, or fails when
+// --error-duplicates is set
+func reportDuplicates(path string, duplicates []duplicateKey, options DiffOptions) error {
+	if len(duplicates) == 0 || (!options.WarnDuplicates && !options.ErrorDuplicates) {
+		return nil
+	}
+
+	for _, dup := range duplicates {
+		location := ""
+		if dup.Line > 0 {
+			location = fmt.Sprintf(" (line %d)", dup.Line)
+		}
+		warnf(options, "WARNING: Duplicate key '%s' in '%s'%s", dup.Key, path, location)
+	}
+
+	if options.ErrorDuplicates {
+		return fmt.Errorf("file '%s' contains %d duplicate key(s), aborting as --error-duplicates is enabled", path, len(duplicates))
+	}
+
+	return nil
+}
+
+// decodeYAMLLastWins decodes YAML like yaml.Unmarshal, but instead of failing
+// on duplicate mapping keys it keeps the last occurrence and reports the others
+func decodeYAMLLastWins(data []byte, out interface{}) ([]duplicateKey, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+
+	var duplicates []duplicateKey
+	removeYAMLDuplicates(&node, "", &duplicates)
+
+	// An empty document has no content to decode
+	if node.Kind == 0 {
+		return duplicates, nil
+	}
+
+	return duplicates, node.Decode(out)
+}
+
+// removeYAMLDuplicates walks a YAML node tree and drops all but the last
+// occurrence of each key in every mapping
+func removeYAMLDuplicates(node *yaml.Node, prefix string, duplicates *[]duplicateKey) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPrefix := prefix
+			if node.Kind == yaml.SequenceNode {
+				childPrefix = sopsdiff.IndexKeyPath(prefix, i, pathStyleDot)
+			}
+			removeYAMLDuplicates(child, childPrefix, duplicates)
+		}
+	case yaml.MappingNode:
+		lastIndex := make(map[string]int)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			lastIndex[node.Content[i].Value] = i
+		}
+
+		var content []*yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+
+			// Merge keys may legitimately repeat
+			if keyNode.Value != "<<" && lastIndex[keyNode.Value] != i {
+				*duplicates = append(*duplicates, duplicateKey{
+					Key:  sopsdiff.JoinKeyPath(prefix, keyNode.Value, pathStyleDot),
+					Line: keyNode.Line,
+				})
+				continue
+			}
+
+			removeYAMLDuplicates(valueNode, sopsdiff.JoinKeyPath(prefix, keyNode.Value, pathStyleDot), duplicates)
+			content = append(content, keyNode, valueNode)
+		}
+		node.Content = content
+	}
+}
+
+// findJSONDuplicates scans a JSON document for repeated object members, which
+// encoding/json would otherwise silently collapse to the last value
+func findJSONDuplicates(data []byte) ([]duplicateKey, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var duplicates []duplicateKey
+
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		delim, ok := token.(json.Delim)
+		if !ok {
+			return nil
+		}
+
+		switch delim {
+		case '{':
+			seen := make(map[string]bool)
+			for decoder.More() {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				key := keyToken.(string)
+				path := sopsdiff.JoinKeyPath(prefix, key, pathStyleDot)
+				if seen[key] {
+					duplicates = append(duplicates, duplicateKey{Key: path, Line: lineAtOffset(data, decoder.InputOffset())})
+				}
+				seen[key] = true
+
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for i := 0; decoder.More(); i++ {
+				if err := walk(sopsdiff.IndexKeyPath(prefix, i, pathStyleDot)); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Consume the closing delimiter
+		_, err = decoder.Token()
+		return err
+	}
+
+	if err := walk(""); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return duplicates, nil
+}
+
+// lineAtOffset returns the 1-based line number of a byte offset
+func lineAtOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return strings.Count(string(data[:offset]), "\n") + 1
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureStderr returns what fn writes to stderr
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	fn()
+	require.NoError(t, w.Close())
+	output, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(output)
+}
+
+func TestParseEnvDuplicateKeepsLastValue(t *testing.T) {
+	env, duplicates, err := parseEnv([]byte("TOKEN=first\nOTHER=1\nTOKEN=second\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"TOKEN", "OTHER"}, env.Keys)
+	assert.Equal(t, "second", env.Values["TOKEN"])
+	assert.Equal(t, []duplicateKey{{Key: "TOKEN", Line: 3}}, duplicates)
+
+	// Two files differing only in the overridden value compare equal
+	other, _, err := parseEnv([]byte("TOKEN=second\nOTHER=1\n"))
+	require.NoError(t, err)
+	assert.False(t, Compare(env.document(), other.document(), testOptions()).HasChanges())
+}
+
+func TestReportDuplicates(t *testing.T) {
+	duplicates := []duplicateKey{{Key: "TOKEN", Line: 3}}
+
+	options := testOptions()
+	output := captureStderr(t, func() {
+		assert.NoError(t, reportDuplicates(".env", duplicates, options))
+	})
+	assert.Empty(t, output)
+
+	options.WarnDuplicates = true
+	output = captureStderr(t, func() {
+		assert.NoError(t, reportDuplicates(".env", duplicates, options))
+	})
+	assert.Contains(t, output, "Duplicate key 'TOKEN' in '.env' (line 3)")
+
+	options = testOptions()
+	options.ErrorDuplicates = true
+	output = captureStderr(t, func() {
+		err := reportDuplicates(".env", duplicates, options)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "--error-duplicates")
+	})
+	assert.Contains(t, output, "Duplicate key 'TOKEN'")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+)
+
+// Exit codes returned by the sops-diff binary
+const (
+	exitCodeError          = 1
+	exitCodeReadError      = 2
+	exitCodeDecryptError   = 3
+	exitCodeMissingKey     = 4
+	exitCodeParseError     = 5
+	exitCodeFormatMismatch = 6
+	exitCodeDecryptedFile  = 7
+)
+
+// ReadError is returned when an input file cannot be read
+type ReadError struct {
+	Path string
+	Err  error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("error reading file %s: %v", e.Path, e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// DecryptError is returned when SOPS fails to decrypt an input file
+type DecryptError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("error decrypting %s: %v", e.Path, e.Err)
+}
+
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+// MissingKeyError is returned when none of the keys a file is encrypted
+// with could be used to recover its data key
+type MissingKeyError struct {
+	Path string
+	Err  error
+}
+
+func (e *MissingKeyError) Error() string {
+	return fmt.Sprintf("error decrypting %s: no usable key found: %v", e.Path, e.Err)
+}
+
+func (e *MissingKeyError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned when decrypted content is not valid for its format
+type ParseError struct {
+	Path   string
+	Format string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("error parsing %s from %s: %v", strings.ToUpper(e.Format), e.Path, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// FormatMismatchError is returned when the two inputs are detected as
+// different formats
+type FormatMismatchError struct {
+	Format1 string
+	Format2 string
+}
+
+func (e *FormatMismatchError) Error() string {
+	return fmt.Sprintf("files appear to be different formats: %s and %s (use --allow-format-mismatch to compare them anyway)", e.Format1, e.Format2)
+}
+
+// BinaryStoreError is returned when a file SOPS encrypted as binary was
+// detected as YAML
+type BinaryStoreError struct {
+	Path   string
+	Format string
+}
+
+func (e *BinaryStoreError) Error() string {
+	return fmt.Sprintf("'%s' was encrypted by SOPS as a binary file (--input-type binary), so it cannot be compared as %s: "+
+		"use --format xml, ndjson or plist if it holds one of those, or --format binary to diff the decrypted content line by line", e.Path, e.Format)
+}
+
+// DecryptedFileError is returned when a plaintext file is found while
+// --error-on-decrypted is enabled
+type DecryptedFileError struct {
+	Path string
+}
+
+func (e *DecryptedFileError) Error() string {
+	return fmt.Sprintf("file '%s' is decrypted, aborting as --error-on-decrypted is enabled", e.Path)
+}
+
+// errNoDataKey is matched by sops binary failures whose stderr reports that
+// no key could recover the data key, the same failure the library returns as
+// a sops.UserError
+var errNoDataKey = errors.New("failed to get the data key")
+
+// sopsBinaryError is a decryption failure reported by the sops binary
+type sopsBinaryError struct {
+	Stderr string
+}
+
+func (e *sopsBinaryError) Error() string {
+	return fmt.Sprintf("sops decryption failed: %s", e.Stderr)
+}
+
+func (e *sopsBinaryError) Is(target error) bool {
+	return target == errNoDataKey && strings.Contains(e.Stderr, "Failed to get the data key")
+}
+
+// isMissingKey reports whether a raw decryption error means none of the keys
+// could recover the data key. SOPS does not export the error type for it, so
+// the library's user error is recognized by its message prefix.
+func isMissingKey(err error) bool {
+	var userErr sops.UserError
+	if errors.As(err, &userErr) && strings.HasPrefix(userErr.Error(), "Error getting data key") {
+		return true
+	}
+	return errors.Is(err, errNoDataKey)
+}
+
+// newDecryptError classifies a decryption failure, then explains it for
+// display. The raw error is classified, as the explanation rewords it.
+func newDecryptError(path string, err error, options DiffOptions) error {
+	if isMissingKey(err) {
+		return &MissingKeyError{Path: path, Err: explainDecryptError(err, options)}
+	}
+	return &DecryptError{Path: path, Err: explainDecryptError(err, options)}
+}
+
+// exitCode maps an error returned by a command to the process exit code
+func exitCode(err error) int {
+	var readErr *ReadError
+	var decryptErr *DecryptError
+	var missingKeyErr *MissingKeyError
+	var parseErr *ParseError
+	var binaryErr *BinaryStoreError
+	var mismatchErr *FormatMismatchError
+	var decryptedErr *DecryptedFileError
+
+	switch {
+	case errors.As(err, &readErr):
+		return exitCodeReadError
+	case errors.As(err, &missingKeyErr):
+		return exitCodeMissingKey
+	case errors.As(err, &decryptErr):
+		return exitCodeDecryptError
+	case errors.As(err, &parseErr), errors.As(err, &binaryErr):
+		return exitCodeParseError
+	case errors.As(err, &mismatchErr):
+		return exitCodeFormatMismatch
+	case errors.As(err, &decryptedErr):
+		return exitCodeDecryptedFile
+	default:
+		return exitCodeError
+	}
+}
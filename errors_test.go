@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDataKeyError mirrors the unexported error SOPS returns when no key
+// could recover the data key
+type fakeDataKeyError struct {
+	details string
+}
+
+func (e *fakeDataKeyError) Error() string {
+	return "Error getting data key: 0 successful groups required, got 0"
+}
+
+func (e *fakeDataKeyError) UserError() string {
+	return "Failed to get the data key required to decrypt the SOPS file.\n\n" + e.details
+}
+
+func TestNewDecryptErrorClassifiesLibraryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		missing bool
+	}{
+		{"no usable key", &fakeDataKeyError{details: "could not decrypt group 0"}, true},
+		{"KMS access denied", &fakeDataKeyError{details: "AccessDeniedException: not allowed"}, true},
+		{"other failure", errors.New("Error unmarshalling input"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newDecryptError("secrets.yaml", tt.err, testOptions())
+
+			var missingKeyErr *MissingKeyError
+			var decryptErr *DecryptError
+			if tt.missing {
+				require.True(t, errors.As(err, &missingKeyErr), "unexpected error: %v", err)
+				assert.Equal(t, exitCodeMissingKey, exitCode(err))
+			} else {
+				require.True(t, errors.As(err, &decryptErr), "unexpected error: %v", err)
+				assert.Equal(t, exitCodeDecryptError, exitCode(err))
+			}
+		})
+	}
+}
+
+func TestNewDecryptErrorKeepsKMSExplanation(t *testing.T) {
+	err := newDecryptError("secrets.yaml", &fakeDataKeyError{details: "AccessDeniedException"}, testOptions())
+
+	var missingKeyErr *MissingKeyError
+	require.True(t, errors.As(err, &missingKeyErr))
+	assert.Contains(t, err.Error(), "AWS KMS denied access")
+}
+
+func TestNewDecryptErrorClassifiesSopsBinaryErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake sops binary is a shell script")
+	}
+
+	fakeSops := func(stderr string) string {
+		path := filepath.Join(t.TempDir(), "sops")
+		script := "#!/bin/sh\necho '" + stderr + "' >&2\nexit 128\n"
+		require.NoError(t, os.WriteFile(path, []byte(script), 0700))
+		return path
+	}
+
+	options := testOptions()
+	options.SopsBinary = fakeSops("Failed to get the data key required to decrypt the SOPS file.")
+	_, err := decryptWithSopsBinary([]byte("a: ENC[AES256_GCM,data:x]\n"), "yaml", options)
+	require.Error(t, err)
+
+	var missingKeyErr *MissingKeyError
+	assert.True(t, errors.As(newDecryptError("secrets.yaml", err, options), &missingKeyErr), "unexpected error: %v", err)
+
+	options.SopsBinary = fakeSops("Error unmarshalling input yaml")
+	_, err = decryptWithSopsBinary([]byte("a: ENC[AES256_GCM,data:x]\n"), "yaml", options)
+	require.Error(t, err)
+
+	var decryptErr *DecryptError
+	assert.True(t, errors.As(newDecryptError("secrets.yaml", err, options), &decryptErr), "unexpected error: %v", err)
+}
@@ -11,12 +11,12 @@ import (
 	"strings"
 
 	"github.com/fatih/color"
-	"github.com/mattn/go-isatty"
+	"gopkg.in/yaml.v3"
 )
 
 // colorizeConflictOutput adds ANSI color codes to conflict markers and content
 // for better readability in terminal output
-func colorizeConflictOutput(content string) string {
+func colorizeConflictOutput(content string, colors colorScheme) string {
 	lines := strings.Split(content, "\n")
 	var colored []string
 
@@ -27,14 +27,14 @@ func colorizeConflictOutput(content string) string {
 		// Colorize conflict markers
 		if strings.HasPrefix(line, "<<<<<<< ") {
 			// Cyan color for start marker
-			colored = append(colored, "\033[36m"+line+"\033[0m")
+			colored = append(colored, colors.Header+line+colorReset)
 			inOurs = true
 			continue
 		}
 
 		if line == "=======" {
 			// Cyan color for separator marker
-			colored = append(colored, "\033[36m"+line+"\033[0m")
+			colored = append(colored, colors.Header+line+colorReset)
 			inOurs = false
 			inTheirs = true
 			continue
@@ -42,18 +42,18 @@ func colorizeConflictOutput(content string) string {
 
 		if strings.HasPrefix(line, ">>>>>>> ") {
 			// Cyan color for end marker
-			colored = append(colored, "\033[36m"+line+"\033[0m")
+			colored = append(colored, colors.Header+line+colorReset)
 			inTheirs = false
 			continue
 		}
 
 		// Colorize content
 		if inOurs {
-			// Red color for "our" changes
-			colored = append(colored, "\033[31m"+line+"\033[0m")
+			// The removed color (red by default) for "our" changes
+			colored = append(colored, colors.Removed+line+colorReset)
 		} else if inTheirs {
-			// Green color for "their" changes
-			colored = append(colored, "\033[32m"+line+"\033[0m")
+			// The added color (green by default) for "their" changes
+			colored = append(colored, colors.Added+line+colorReset)
 		} else {
 			// Normal text without color
 			colored = append(colored, line)
@@ -141,9 +141,118 @@ func mergeVersions(oursContent, theirsContent string) (string, error) {
 	return string(mergedContent), nil
 }
 
+// decryptConflictSides decrypts both sides of a conflict through
+// decryptBytes, so the plaintext never touches the disk
+func decryptConflictSides(filePath, oursContent, theirsContent string, options DiffOptions) ([]byte, []byte, error) {
+	format := detectFormat(filePath, options)
+	decryptFormat := sopsStoreFormat(format)
+
+	oursDecrypted, err := decryptBytes([]byte(oursContent), decryptFormat, options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt 'ours' version: %w", err)
+	}
+
+	theirsDecrypted, err := decryptBytes([]byte(theirsContent), decryptFormat, options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt 'theirs' version: %w", err)
+	}
+
+	// Deeply nested sides are refused before the key report or interactive
+	// resolution recurse through them. Sides that don't parse are left to
+	// those, which fall back to whole-file markers.
+	for _, side := range []struct {
+		name      string
+		decrypted []byte
+	}{{"ours", oursDecrypted}, {"theirs", theirsDecrypted}} {
+		if data, err := decodeConflictSide(side.decrypted, format); err == nil {
+			if err := checkDepth(data, options.MaxDepth); err != nil {
+				return nil, nil, fmt.Errorf("error parsing '%s' version: %w", side.name, err)
+			}
+		}
+	}
+
+	return oursDecrypted, theirsDecrypted, nil
+}
+
+// decodeConflictSide decodes one decrypted side of a conflict according to
+// the file's format
+func decodeConflictSide(decrypted []byte, format string) (interface{}, error) {
+	switch format {
+	case "yaml":
+		var data interface{}
+		err := yaml.Unmarshal(decrypted, &data)
+		return data, err
+	case "json":
+		return unmarshalJSON(decrypted)
+	case "xml":
+		return parseXML(decrypted)
+	case "plist":
+		return parsePlist(decrypted)
+	case "ndjson":
+		return parseNDJSON(decrypted)
+	case "env":
+		env, _, err := parseEnv(decrypted)
+		return env.document(), err
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// conflictKeyReport lists the keys that differ between the decrypted sides of
+// a conflict, parsed according to the file's format
+func conflictKeyReport(filePath string, oursDecrypted, theirsDecrypted []byte, options DiffOptions) (string, error) {
+	format := detectFormat(filePath, options)
+
+	if format == "env" {
+		oursEnv, _, err := parseEnv(oursDecrypted)
+		if err != nil {
+			return "", fmt.Errorf("error parsing 'ours' version: %w", err)
+		}
+		theirsEnv, _, err := parseEnv(theirsDecrypted)
+		if err != nil {
+			return "", fmt.Errorf("error parsing 'theirs' version: %w", err)
+		}
+		return compareEnvData(oursEnv, theirsEnv, options)
+	}
+
+	oursData, err := decodeConflictSide(oursDecrypted, format)
+	if err != nil {
+		return "", fmt.Errorf("error parsing 'ours' version: %w", err)
+	}
+	theirsData, err := decodeConflictSide(theirsDecrypted, format)
+	if err != nil {
+		return "", fmt.Errorf("error parsing 'theirs' version: %w", err)
+	}
+
+	return compareData(oursData, theirsData, options)
+}
+
+// printConflictKeyReport shows which keys conflict before the marker output.
+// If the sides can't be parsed, only the whole-file markers are shown.
+func printConflictKeyReport(filePath string, oursDecrypted, theirsDecrypted []byte, options DiffOptions) {
+	report, err := conflictKeyReport(filePath, oursDecrypted, theirsDecrypted, options)
+	if err != nil {
+		warnf(options, "Note: could not compare the conflict per key (%v), showing the whole file", err)
+		return
+	}
+
+	if report == "" {
+		fmt.Println("No conflicting keys: both sides decrypt to the same values")
+	} else {
+		fmt.Println("Conflicting keys:")
+		fmt.Println("! = differs between sides, + = only in theirs, - = only in ours")
+		fmt.Println("--------------------------------------")
+		fmt.Print(report)
+	}
+	fmt.Println()
+}
+
 // HandleGitConflicts resolves Git merge conflicts in SOPS encrypted files
-func HandleGitConflicts(filePath string, options DiffOptions, viewAsDiff bool) error {
+func HandleGitConflicts(filePath string, options DiffOptions, viewAsDiff, interactive bool) error {
 	// Read the file with conflicts
+	if err := checkFileSize(filePath, options.MaxFileSize); err != nil {
+		return fmt.Errorf("error reading file %s: %w", filePath, err)
+	}
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("error reading file %s: %w", filePath, err)
@@ -154,42 +263,24 @@ func HandleGitConflicts(filePath string, options DiffOptions, viewAsDiff bool) e
 		return fmt.Errorf("file %s does not contain Git conflicts", filePath)
 	}
 
-	// Create the output paths
-	fileExt := filepath.Ext(filePath)
-	baseName := filepath.Base(filePath)
-	baseNameNoExt := strings.TrimSuffix(baseName, fileExt)
-	workDir := filepath.Dir(filePath)
-
-	oursPath := filepath.Join(workDir, baseNameNoExt+".ours"+fileExt)
-	theirsPath := filepath.Join(workDir, baseNameNoExt+".theirs"+fileExt)
-
 	// Extract both versions from the conflict
 	contentStr := string(content)
 	oursContent := extractOursVersion(contentStr)
 	theirsContent := extractTheirsVersion(contentStr)
 
-	// Write the two versions to temporary files
-	err = ioutil.WriteFile(oursPath, []byte(oursContent), 0600)
-	if err != nil {
-		return fmt.Errorf("failed to write 'ours' version: %w", err)
-	}
-	defer cleanupFile(oursPath)
-
-	err = ioutil.WriteFile(theirsPath, []byte(theirsContent), 0600)
-	if err != nil {
-		return fmt.Errorf("failed to write 'theirs' version: %w", err)
+	// Export key provider settings before any decryption happens
+	if err := applyKeyProviderEnv(options); err != nil {
+		return err
 	}
-	defer cleanupFile(theirsPath)
 
-	// Decrypt both versions using the sops command line and keep in memory
-	oursDecrypted, err := decryptWithSopsToMemory(oursPath)
+	// Decrypt both versions and keep them in memory
+	oursDecrypted, theirsDecrypted, err := decryptConflictSides(filePath, oursContent, theirsContent, options)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt 'ours' version: %w", err)
+		return err
 	}
 
-	theirsDecrypted, err := decryptWithSopsToMemory(theirsPath)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt 'theirs' version: %w", err)
+	if interactive {
+		return resolveConflictsInteractively(filePath, oursDecrypted, theirsDecrypted, options)
 	}
 
 	// Auto-merge logic based on flags
@@ -207,6 +298,9 @@ func HandleGitConflicts(filePath string, options DiffOptions, viewAsDiff bool) e
 			currentBranch, string(oursDecrypted), string(theirsDecrypted), mergingBranch)
 	}
 
+	// List the conflicting keys, without values
+	printConflictKeyReport(filePath, oursDecrypted, theirsDecrypted, options)
+
 	// Display helpful information
 	cyan := color.New(color.FgCyan).SprintFunc()
 	yellow := color.New(color.FgYellow).SprintFunc()
@@ -230,9 +324,9 @@ func HandleGitConflicts(filePath string, options DiffOptions, viewAsDiff bool) e
 		fmt.Printf("   mv %s %s\n", options.OutputFile+".enc", filePath)
 	} else {
 		// Print to stdout
-		if options.ColorOutput && isatty.IsTerminal(os.Stdout.Fd()) {
+		if useColor(options) {
 			// Apply coloring if color is enabled and output is to a terminal
-			fmt.Print(colorizeConflictOutput(mergedContent))
+			fmt.Print(colorizeConflictOutput(mergedContent, options.Colors))
 		} else {
 			// Regular output without coloring
 			fmt.Print(mergedContent)
@@ -246,25 +340,117 @@ func HandleGitConflicts(filePath string, options DiffOptions, viewAsDiff bool) e
 }
 
 // HandleGitMerge handles a Git merge operation using the sops-diff tool
-// This function is called by Git when merging encrypted files
-func HandleGitMerge(local, base, remote, merged string, options DiffOptions) error {
-	// Decrypt all the files directly without reading their content into unused variables
-	localDecrypted, err := decryptWithSopsToMemory(local)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt local version: %w", err)
+// This function is called by Git when merging encrypted files. The result is
+// written to output: MERGED for the merge tool, and LOCAL for the merge
+// driver, as Git only keeps %A
+func HandleGitMerge(local, base, remote, merged, output string, options DiffOptions, dryRun bool) error {
+	// The result is re-encrypted with the sops binary, which a dry run
+	// doesn't need
+	var sopsBin string
+	if !dryRun {
+		var err error
+		sopsBin, err = lookupSopsBinary(options)
+		if err != nil {
+			return err
+		}
 	}
 
-	baseDecrypted, err := decryptWithSopsToMemory(base)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt base version: %w", err)
+	// Git's temporary copies have no extension, so the format comes from
+	// the merged path
+	format := detectFormat(merged, options)
+
+	// A dry run prints the resolved plaintext instead of encrypting it over
+	// merged, with the status messages moved to stderr to keep it clean
+	status := os.Stdout
+	if dryRun {
+		status = os.Stderr
+	}
+	finish := func(result []byte) error {
+		if dryRun {
+			fmt.Print(string(result))
+			return nil
+		}
+		return encryptMergeResult(sopsBin, format, merged, output, result)
+	}
+
+	// Export key provider settings before any decryption happens
+	if err := applyKeyProviderEnv(options); err != nil {
+		return err
+	}
+
+	decryptSide := func(name, path string) ([]byte, error) {
+		if err := checkFileSize(path, options.MaxFileSize); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+
+		decrypted, err := decryptBytes(content, sopsStoreFormat(format), options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s version: %w", name, explainDecryptError(err, options))
+		}
+		return decrypted, nil
 	}
 
-	remoteDecrypted, err := decryptWithSopsToMemory(remote)
+	localDecrypted, err := decryptSide("local", local)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt remote version: %w", err)
+		return err
+	}
+	baseDecrypted, err := decryptSide("base", base)
+	if err != nil {
+		return err
+	}
+	remoteDecrypted, err := decryptSide("remote", remote)
+	if err != nil {
+		return err
+	}
+
+	// The ciphertext differs even when only one side changed, so compare the
+	// plaintext against base and take the changed side without markers
+	if bytes.Equal(localDecrypted, baseDecrypted) {
+		fmt.Fprintln(status, "Only the remote version changed, taking it.")
+		return finish(remoteDecrypted)
+	}
+	if bytes.Equal(remoteDecrypted, baseDecrypted) {
+		fmt.Fprintln(status, "Only the local version changed, taking it.")
+		return finish(localDecrypted)
+	}
+
+	// Merge key by key, so only keys changed differently on both sides conflict
+	keyMerged, conflicts, err := mergeDocuments(baseDecrypted, localDecrypted, remoteDecrypted, format, options.MaxDepth)
+	if err == nil && len(conflicts) == 0 {
+		fmt.Fprintln(status, "Merged all keys without conflicts.")
+		return finish(keyMerged)
+	}
+
+	// Initial merged content with conflict markers
+	var mergedContent string
+	if err == nil {
+		fmt.Fprintf(status, "Conflicting keys: %s\n", strings.Join(conflicts, ", "))
+		mergedContent = string(keyMerged)
+	} else {
+		fmt.Fprintf(os.Stderr, "Note: could not merge key by key (%v), marking the whole file as conflicting\n", err)
+		mergedContent = fmt.Sprintf("<<<<<<< LOCAL\n%s=======\n%s>>>>>>> REMOTE\n",
+			string(localDecrypted), string(remoteDecrypted))
+	}
+
+	// The conflicts a dry run would leave are shown, without running the tool
+	if dryRun {
+		fmt.Print(mergedContent)
+		return fmt.Errorf("merge would leave conflicts to resolve")
 	}
 
-	// Create temporary files for decrypted content to use with diff tool
+	// Without a diff tool the conflict markers would stay, so no plaintext
+	// is written to disk
+	if options.DiffTool == "" {
+		fmt.Println("No diff tool specified. Using default merge with conflict markers.")
+		fmt.Println("Merge not complete: conflict markers still present in the merged file.")
+		return fmt.Errorf("conflicts not resolved")
+	}
+
+	// Only the diff tool needs the decrypted versions as files
 	tmpDir, err := ioutil.TempDir("", "sops-merge-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temporary directory: %w", err)
@@ -272,7 +458,6 @@ func HandleGitMerge(local, base, remote, merged string, options DiffOptions) err
 	defer os.RemoveAll(tmpDir)
 
 	localDecPath := filepath.Join(tmpDir, "LOCAL")
-	baseDecPath := filepath.Join(tmpDir, "BASE")
 	remoteDecPath := filepath.Join(tmpDir, "REMOTE")
 	mergedDecPath := filepath.Join(tmpDir, "MERGED")
 
@@ -281,34 +466,21 @@ func HandleGitMerge(local, base, remote, merged string, options DiffOptions) err
 		return fmt.Errorf("failed to write decrypted local file: %w", err)
 	}
 
-	if err := ioutil.WriteFile(baseDecPath, baseDecrypted, 0600); err != nil {
-		return fmt.Errorf("failed to write decrypted base file: %w", err)
-	}
-
 	if err := ioutil.WriteFile(remoteDecPath, remoteDecrypted, 0600); err != nil {
 		return fmt.Errorf("failed to write decrypted remote file: %w", err)
 	}
 
-	// Initial merged content with conflict markers
-	mergedContent := fmt.Sprintf("<<<<<<< LOCAL\n%s=======\n%s>>>>>>> REMOTE\n",
-		string(localDecrypted), string(remoteDecrypted))
-
 	if err := ioutil.WriteFile(mergedDecPath, []byte(mergedContent), 0600); err != nil {
 		return fmt.Errorf("failed to write initial merged file: %w", err)
 	}
 
-	// Launch external diff tool if specified
-	if options.DiffTool != "" {
-		diffCmd := exec.Command(options.DiffTool, localDecPath, remoteDecPath, mergedDecPath)
-		diffCmd.Stdin = os.Stdin
-		diffCmd.Stdout = os.Stdout
-		diffCmd.Stderr = os.Stderr
+	diffCmd := exec.Command(options.DiffTool, localDecPath, remoteDecPath, mergedDecPath)
+	diffCmd.Stdin = os.Stdin
+	diffCmd.Stdout = os.Stdout
+	diffCmd.Stderr = os.Stderr
 
-		if err := diffCmd.Run(); err != nil {
-			return fmt.Errorf("diff tool failed: %w", err)
-		}
-	} else {
-		fmt.Println("No diff tool specified. Using default merge with conflict markers.")
+	if err := diffCmd.Run(); err != nil {
+		return fmt.Errorf("diff tool failed: %w", err)
 	}
 
 	// Read the merged result
@@ -323,8 +495,16 @@ func HandleGitMerge(local, base, remote, merged string, options DiffOptions) err
 		return fmt.Errorf("conflicts not resolved")
 	}
 
+	return encryptMergeResult(sopsBin, format, merged, output, mergedResult)
+}
+
+// encryptMergeResult encrypts the merged plaintext with sops and writes it to
+// output. The plaintext is read from stdin, so name is passed as the file
+// name, for the creation rules in .sops.yaml to match the real path.
+func encryptMergeResult(sopsBin, format, name, output string, mergedResult []byte) error {
 	// Encrypt the merged result
-	cmd := exec.Command("sops", "-e", "--input-type", filepath.Ext(merged)[1:], "--output-type", filepath.Ext(merged)[1:], "/dev/stdin")
+	storeFormat := sopsStoreFormat(format)
+	cmd := exec.Command(sopsBin, "-e", "--input-type", storeFormat, "--output-type", storeFormat, "--filename-override", name, "/dev/stdin")
 	cmd.Stdin = bytes.NewReader(mergedResult)
 	encryptedOutput, err := cmd.Output()
 	if err != nil {
@@ -334,8 +514,8 @@ func HandleGitMerge(local, base, remote, merged string, options DiffOptions) err
 		return fmt.Errorf("sops encryption failed: %w", err)
 	}
 
-	// Write the encrypted result to the merged file
-	if err := ioutil.WriteFile(merged, encryptedOutput, 0600); err != nil {
+	// Write the encrypted result to the output file
+	if err := ioutil.WriteFile(output, encryptedOutput, 0600); err != nil {
 		return fmt.Errorf("failed to write encrypted merged file: %w", err)
 	}
 
@@ -343,18 +523,24 @@ func HandleGitMerge(local, base, remote, merged string, options DiffOptions) err
 	return nil
 }
 
-// setupGitMergeTool configures Git to use sops-diff for resolving conflicts in encrypted files
-func SetupGitMergeTool() error {
+// setupGitMergeTool configures Git to use sops-diff for resolving conflicts in encrypted files,
+// and with textconv also for showing them decrypted in git diff and git log -p
+func SetupGitMergeTool(textconv bool) error {
 	// Configure Git to use sops-diff as a merge tool
 	cmds := []struct {
 		args []string
 	}{
 		{[]string{"config", "--global", "merge.sops.name", "SOPS merge tool"}},
-		{[]string{"config", "--global", "merge.sops.driver", "sops-diff git-merge %A %O %B %P"}},
+		{[]string{"config", "--global", "merge.sops.driver", "sops-diff git-merge --driver %A %O %B %P"}},
 		{[]string{"config", "--global", "merge.sops.recursive", "binary"}},
 		{[]string{"config", "--global", "mergetool.sops.cmd", "sops-diff git-merge --diff-tool=$EDITOR $LOCAL $BASE $REMOTE $MERGED"}},
 		{[]string{"config", "--global", "mergetool.sops.trustExitCode", "true"}},
 	}
+	if textconv {
+		cmds = append(cmds, struct {
+			args []string
+		}{[]string{"config", "--global", "diff.sops.textconv", "sops-diff textconv"}})
+	}
 
 	for _, cmd := range cmds {
 		if err := exec.Command("git", cmd.args...).Run(); err != nil {
@@ -368,31 +554,30 @@ func SetupGitMergeTool() error {
 	fmt.Println(green("✓"), "Successfully configured Git to use sops-diff for encrypted files")
 	fmt.Println(yellow("Next steps:"))
 	fmt.Println("Add the following to your .gitattributes file:")
-	fmt.Println("*.enc.yaml merge=sops")
-	fmt.Println("*.enc.json merge=sops")
-	fmt.Println("*.enc.env merge=sops")
+	attributes := "merge=sops"
+	if textconv {
+		attributes = "merge=sops diff=sops"
+	}
+	fmt.Println("*.enc.yaml " + attributes)
+	fmt.Println("*.enc.json " + attributes)
+	fmt.Println("*.enc.env " + attributes)
 
 	return nil
 }
 
-// cleanupFile safely removes a file
-func cleanupFile(path string) {
-	_ = ioutil.WriteFile(path, []byte{}, 0600) // Overwrite with empty content first
-	_ = os.Remove(path)
-}
+// lookupSopsBinary resolves the sops executable used for encryption and by --decryptor=binary
+func lookupSopsBinary(options DiffOptions) (string, error) {
+	name := options.SopsBinary
+	if name == "" {
+		name = "sops"
+	}
 
-// decryptWithSopsToMemory decrypts a file using the sops command line and returns the content
-func decryptWithSopsToMemory(inputPath string) ([]byte, error) {
-	cmd := exec.Command("sops", "-d", inputPath)
-	output, err := cmd.Output()
+	path, err := exec.LookPath(name)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("sops decryption failed: %s", exitErr.Stderr)
-		}
-		return nil, fmt.Errorf("sops decryption failed: %w", err)
+		return "", fmt.Errorf("sops not found (%s); install it or set --sops-bin", name)
 	}
 
-	return output, nil
+	return path, nil
 }
 
 // extractOursVersion extracts the "our" version from the conflict
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+)
+
+// hunkHeader matches the ranges of a unified diff hunk header
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(,\d+)? \+(\d+)(,\d+)? @@`)
+
+// parentKeyLine matches a YAML or JSON line that opens a nested map or list,
+// such as "db:" or `"db": {`, capturing its indentation and key
+var parentKeyLine = regexp.MustCompile(`^(\s*)("(?:[^"\\]|\\.)*"|'(?:[^']|'')*'|[^\s"'#\-\[{:][^:]*?):\s*[\[{]?\s*$`)
+
+// addHunkContext appends the key path enclosing the first changed line of
+// each hunk to its header, like the function context of git diff
+// (@@ -4,7 +4,7 @@ spec.database). text1 and text2 are the documents the diff
+// was made from.
+func addHunkContext(diff, text1, text2, style string) string {
+	lines := strings.SplitAfter(diff, "\n")
+	lines1 := strings.Split(text1, "\n")
+	lines2 := strings.Split(text2, "\n")
+
+	for i, line := range lines {
+		match := hunkHeader.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		oldLine, newLine := hunkStart(match[1], match[2]), hunkStart(match[3], match[4])
+
+		// Skip the leading context to the first changed line
+		context := ""
+		for _, body := range lines[i+1:] {
+			if strings.HasPrefix(body, "-") {
+				context = enclosingKeyPath(lines1, oldLine, style)
+				break
+			}
+			if strings.HasPrefix(body, "+") {
+				context = enclosingKeyPath(lines2, newLine, style)
+				break
+			}
+			if !strings.HasPrefix(body, " ") {
+				break
+			}
+			oldLine++
+			newLine++
+		}
+
+		if context != "" {
+			lines[i] = strings.TrimSuffix(line, "\n") + " " + context + "\n"
+		}
+	}
+
+	return strings.Join(lines, "")
+}
+
+// hunkStart returns the zero-based index of the first line of a hunk range.
+// An empty range is numbered after the line before it.
+func hunkStart(start, length string) int {
+	line, _ := strconv.Atoi(start)
+	if length == ",0" {
+		return line
+	}
+	return line - 1
+}
+
+// enclosingKeyPath returns the path of the map keys enclosing lines[index],
+// judged by indentation. Keys of list items are not tracked, so paths inside
+// lists stop at the list itself.
+func enclosingKeyPath(lines []string, index int, style string) string {
+	if index >= len(lines) {
+		return ""
+	}
+
+	type parent struct {
+		indent int
+		key    string
+	}
+	var stack []parent
+
+	indentOf := func(line string) int {
+		return len(line) - len(strings.TrimLeft(line, " \t"))
+	}
+	popTo := func(indent int) {
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	for _, line := range lines[:index] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := indentOf(line)
+		popTo(indent)
+		if match := parentKeyLine.FindStringSubmatch(line); match != nil {
+			stack = append(stack, parent{indent: indent, key: unquoteKey(match[2])})
+		}
+	}
+	popTo(indentOf(lines[index]))
+
+	path := ""
+	for _, p := range stack {
+		path = sopsdiff.JoinKeyPath(path, p.key, style)
+	}
+	return path
+}
+
+// unquoteKey removes the quotes of a double- or single-quoted YAML or JSON key
+func unquoteKey(key string) string {
+	if strings.HasPrefix(key, `"`) {
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			return unquoted
+		}
+	}
+	if strings.HasPrefix(key, "'") && len(key) >= 2 {
+		return strings.ReplaceAll(key[1:len(key)-1], "''", "'")
+	}
+	return strings.TrimSpace(key)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+	"gopkg.in/yaml.v3"
+)
+
+// conflictChooser picks the resolution of one conflicting key
+type conflictChooser func(path string, ours, theirs mergeSide) (mergeSide, error)
+
+// resolveConflicts walks both sides of a conflict and asks choose for every
+// key that differs, recursing into maps present on both sides so only
+// leaves and whole subtrees that exist on one side are asked about
+func resolveConflicts(path string, ours, theirs mergeSide, choose conflictChooser) (mergeSide, error) {
+	if sameSide(ours, theirs) {
+		return ours, nil
+	}
+
+	oursMap, oursIsMap := ours.value.(map[string]interface{})
+	theirsMap, theirsIsMap := theirs.value.(map[string]interface{})
+	if ours.present && theirs.present && oursIsMap && theirsIsMap {
+		keys := make(map[string]bool)
+		for _, m := range []map[string]interface{}{oursMap, theirsMap} {
+			for k := range m {
+				keys[k] = true
+			}
+		}
+
+		result := make(map[string]interface{})
+		for _, k := range sortedKeySet(keys) {
+			side := func(m map[string]interface{}) mergeSide {
+				v, ok := m[k]
+				return mergeSide{value: v, present: ok}
+			}
+
+			resolved, err := resolveConflicts(sopsdiff.JoinKeyPath(path, k, pathStyleDot), side(oursMap), side(theirsMap), choose)
+			if err != nil {
+				return mergeSide{}, err
+			}
+			if resolved.present {
+				result[k] = resolved.value
+			}
+		}
+		return mergeSide{value: result, present: true}, nil
+	}
+
+	if path == "" {
+		path = rootKeyPath
+	}
+	return choose(path, ours, theirs)
+}
+
+// describeMergeSide renders one side of a conflicting key on a single line
+func describeMergeSide(side mergeSide) string {
+	if !side.present {
+		return "(not set)"
+	}
+	if str, ok := side.value.(string); ok {
+		return fmt.Sprintf("%q", str)
+	}
+	if encoded, err := json.Marshal(side.value); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprintf("%v", side.value)
+}
+
+// promptConflictChooser asks on out and reads answers from in for each
+// conflicting key, numbering the conflicts out of total
+func promptConflictChooser(in io.Reader, out io.Writer, total int) conflictChooser {
+	reader := bufio.NewReader(in)
+	current := 0
+
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("no answer given: %w", err)
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	return func(path string, ours, theirs mergeSide) (mergeSide, error) {
+		current++
+		fmt.Fprintf(out, "\nConflict %d/%d: %s\n", current, total, path)
+		fmt.Fprintf(out, "  ours:   %s\n", describeMergeSide(ours))
+		fmt.Fprintf(out, "  theirs: %s\n", describeMergeSide(theirs))
+
+		for {
+			fmt.Fprint(out, "Keep [o]urs, [t]heirs or [e]dit the value? ")
+			answer, err := readLine()
+			if err != nil {
+				return mergeSide{}, err
+			}
+
+			switch strings.ToLower(answer) {
+			case "o", "ours":
+				return ours, nil
+			case "t", "theirs":
+				return theirs, nil
+			case "e", "edit":
+				fmt.Fprint(out, "New value (YAML syntax, e.g. a string, 42 or true): ")
+				text, err := readLine()
+				if err != nil {
+					return mergeSide{}, err
+				}
+
+				// Values are typed like YAML scalars, falling back to a string
+				var value interface{}
+				if yaml.Unmarshal([]byte(text), &value) != nil || value == nil {
+					value = text
+				}
+				return mergeSide{value: value, present: true}, nil
+			default:
+				fmt.Fprintln(out, "Please answer o, t or e.")
+			}
+		}
+	}
+}
+
+// resolveDocuments asks on out, reading answers from in, which side to keep
+// for every key that differs between ours and theirs. The choices are written
+// into the 'ours' file, keeping its comments and layout, which is returned
+// with the number of conflicting keys. Sides nesting deeper than maxDepth
+// are refused.
+func resolveDocuments(oursDecrypted, theirsDecrypted []byte, format string, maxDepth int, in io.Reader, out io.Writer) (string, int, error) {
+	ours, err := parseMergeDocument(oursDecrypted, format)
+	if err == nil {
+		err = ours.checkDepth(maxDepth)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("error parsing 'ours' version: %w", err)
+	}
+	theirs, err := parseMergeDocument(theirsDecrypted, format)
+	if err == nil {
+		err = theirs.checkDepth(maxDepth)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("error parsing 'theirs' version: %w", err)
+	}
+
+	count := len(ours.values)
+	if len(theirs.values) != count {
+		return "", 0, fmt.Errorf("'ours' and 'theirs' hold different numbers of YAML documents; resolve the conflict by hand")
+	}
+
+	// resolveAll resolves every document, naming the conflicts of a
+	// multi-document file after their document
+	resolveAll := func(choose conflictChooser) ([]interface{}, error) {
+		resolved := make([]interface{}, count)
+		for i := 0; i < count; i++ {
+			chooseInDocument := func(path string, ours, theirs mergeSide) (mergeSide, error) {
+				return choose(documentKeyPath(i, count, path), ours, theirs)
+			}
+
+			side, err := resolveConflicts("",
+				mergeSide{value: ours.values[i], present: true},
+				mergeSide{value: theirs.values[i], present: true},
+				chooseInDocument)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = side.value
+		}
+		return resolved, nil
+	}
+
+	// Count the conflicts first so each prompt can show its position
+	total := 0
+	countConflicts := func(path string, ours, theirs mergeSide) (mergeSide, error) {
+		total++
+		return ours, nil
+	}
+	if _, err := resolveAll(countConflicts); err != nil {
+		return "", 0, err
+	}
+	if total == 0 {
+		fmt.Fprintln(out, "No conflicting keys: both sides decrypt to the same values")
+	}
+
+	resolved, err := resolveAll(promptConflictChooser(in, out, total))
+	if err != nil {
+		return "", 0, err
+	}
+
+	result, err := ours.render(resolved, theirs)
+	if err != nil {
+		return "", 0, fmt.Errorf("error rendering the resolved file: %w", err)
+	}
+	return result, total, nil
+}
+
+// resolveConflictsInteractively asks which side to keep for every key that
+// differs between the decrypted sides of a conflict, then encrypts the result
+// over the conflicted file, or to --output when given
+func resolveConflictsInteractively(filePath string, oursDecrypted, theirsDecrypted []byte, options DiffOptions) error {
+	format := detectFormat(filePath, options)
+
+	result, total, err := resolveDocuments(oursDecrypted, theirsDecrypted, format, options.MaxDepth, os.Stdin, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	sopsBin, err := lookupSopsBinary(options)
+	if err != nil {
+		return err
+	}
+
+	target := filePath
+	if options.OutputFile != "" {
+		target = options.OutputFile
+	}
+	if err := encryptMergeResult(sopsBin, format, filePath, target, []byte(result)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Resolved %d conflicting key(s) into %s. Review it, then run: git add %s\n", total, target, target)
+	return nil
+}
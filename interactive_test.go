@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveDocumentsKeepsOursLayout(t *testing.T) {
+	ours := "# database\nzone: eu\npassword: ours # rotated\n---\nsecond: doc\n"
+	theirs := "# database\nzone: eu\npassword: theirs\n---\nsecond: changed\n"
+
+	// Keep theirs for the password, then ours for the second document
+	result, total, err := resolveDocuments([]byte(ours), []byte(theirs), "yaml", defaultMaxDepth, strings.NewReader("t\no\n"), io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "# database\nzone: eu\npassword: theirs\n---\nsecond: doc\n", result)
+}
+
+func TestResolveDocumentsKeepsEnvQuoting(t *testing.T) {
+	ours := "# app\nGREETING=\"hello world\"\nTOKEN=a\n"
+	theirs := "# app\nGREETING=\"hello world\"\nTOKEN=b\n"
+
+	result, total, err := resolveDocuments([]byte(ours), []byte(theirs), "env", defaultMaxDepth, strings.NewReader("e\nc\n"), io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, "# app\nGREETING=\"hello world\"\nTOKEN=c\n", result)
+}
+
+func TestResolveDocumentsRefusesDeepNesting(t *testing.T) {
+	_, _, err := resolveDocuments([]byte("a:\n  b: 1\n"), []byte("a:\n  b: 2\n"), "yaml", 1, strings.NewReader("o\n"), io.Discard)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--max-depth 1")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+)
+
+// recipientSet lists the master keys in the sops metadata of the content,
+// such as age recipients, PGP fingerprints and KMS ARNs, each prefixed with
+// its key type. It reports false when the content has no sops metadata.
+func recipientSet(content []byte, format string) (map[string]bool, bool) {
+	store := common.StoreForFormat(formats.FormatFromString(format), config.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(content)
+	if err != nil {
+		return nil, false
+	}
+
+	recipients := make(map[string]bool)
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			recipients[key.TypeToIdentifier()+": "+key.ToString()] = true
+		}
+	}
+	return recipients, true
+}
+
+// warnKeySetMismatch warns when two encrypted files are not encrypted to the
+// same recipients, which usually means one of them was encrypted with the
+// wrong .sops.yaml rule. Plaintext inputs are not checked.
+func warnKeySetMismatch(path1 string, content1 []byte, format1 string, path2 string, content2 []byte, format2 string, options DiffOptions) {
+	recipients1, ok1 := recipientSet(content1, format1)
+	recipients2, ok2 := recipientSet(content2, format2)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	only1 := missingRecipients(recipients1, recipients2)
+	only2 := missingRecipients(recipients2, recipients1)
+	if len(only1) == 0 && len(only2) == 0 {
+		return
+	}
+
+	warnf(options, "WARNING: '%s' and '%s' are encrypted to different keys", path1, path2)
+	for _, key := range only1 {
+		warnf(options, "         only in '%s': %s", path1, key)
+	}
+	for _, key := range only2 {
+		warnf(options, "         only in '%s': %s", path2, key)
+	}
+}
+
+// missingRecipients returns the recipients of a that b lacks, sorted
+func missingRecipients(a, b map[string]bool) []string {
+	var missing []string
+	for key := range a {
+		if !b[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
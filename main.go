@@ -2,48 +2,203 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
-	"github.com/getsops/sops/v3/decrypt"
-	"github.com/mattn/go-isatty"
 	"github.com/pmezard/go-difflib/difflib"
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
 	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+	"github.com/xeipuuv/gojsonschema"
 	"gopkg.in/yaml.v3"
 )
 
-const (
-	// Version of the sops-diff utility
+var (
+	// Version of the sops-diff utility, overridden at build time via -ldflags
 	Version = "0.2.0"
+	// CommitSHA is the git commit the binary was built from, set via -ldflags
+	CommitSHA = "unknown"
+	// BuildTime is the UTC build timestamp, set via -ldflags
+	BuildTime = "unknown"
 )
 
 var (
 	// Command line flags
 	summaryMode      bool
 	outputFormat     string
-	colorOutput      bool
+	colorMode        = colorFlag(colorAuto)
 	diffTool         string
 	gitSupport       bool
 	errorOnDecrypted bool
 	gitConflicts     bool
 	outputFile       string
+	useCache         bool
+	cacheDir         string
+	awsProfile       string
+	awsRegion        string
+	ageKeyFile       string
+	ageKey           string
+	sopsBinary       string
+	k8sSecret        bool
+	pathStyle        string
+	warnDuplicates   bool
+	errorDuplicates  bool
+	ignoreKeyCase    bool
+	ignoreValueWS    bool
+	collapseValueWS  bool
+	noPager          bool
+	patchOutput      bool
+	reverseDiff      bool
+	fetchTimeout     time.Duration
+	watchMode        bool
+	gitRevs          []string
+	stagedMode       bool
+	maxLines         int
+	summaryFormat    string
+	noDecompress     bool
+	addedOnly        bool
+	removedOnly      bool
+	placeholderRegex string
+	entropyWarn      bool
+	entropyThreshold float64
+	excludePatterns  []string
+	verbose          bool
+	quiet            bool
+	extensionMap     map[string]string
+	keepComments     bool
+	multilineDiff    bool
+	lengthOnly       bool
+	valueHash        bool
+	hashSalt         string
+	palette          string
+	colorAdded       string
+	colorRemoved     string
+	colorModified    string
+	colorHeader      string
+	numStat          bool
+	nameOnly         bool
+	maxDepth         int
+	maxFileSize      string
+	noLegend         bool
+	showUnchanged    bool
+	diffAlgorithm    string
+	ignoreWS         bool
+	offline          bool
+	retries          int
+	allowMismatch    bool
+	preserveOrder    bool
+	inputType        string
+	decryptor        string
+	schemaPath       string
+	schemaStrict     bool
+	docIndex         int
+	paginate         bool
+	noKeyCheck       bool
+	stripSopsMeta    bool
+	markerAdded      string
+	markerRemoved    string
+	markerModified   string
+	bothMode         bool
+	colorMoved       bool
+	plaintextRef     string
+	keysOnly         bool
+	summaryOut       string
+	noSort           bool
+	expandJSON       bool
 )
 
 type DiffOptions struct {
-	SummaryMode      bool
-	OutputFormat     string
-	ColorOutput      bool
-	DiffTool         string
-	GitSupport       bool
-	ErrorOnDecrypted bool
-	GitConflicts     bool
-	OutputFile       string
+	SummaryMode             bool
+	Both                    bool
+	KeysOnly                bool
+	SummaryOut              string
+	OutputFormat            string
+	ColorOutput             bool
+	ForceColor              bool
+	DiffTool                string
+	GitSupport              bool
+	ErrorOnDecrypted        bool
+	GitConflicts            bool
+	OutputFile              string
+	Cache                   bool
+	CacheDir                string
+	AWSProfile              string
+	AWSRegion               string
+	AgeKeyFile              string
+	AgeKey                  string
+	SopsBinary              string
+	Decryptor               string
+	K8sSecret               bool
+	PathStyle               string
+	WarnDuplicates          bool
+	ErrorDuplicates         bool
+	IgnoreKeyCase           bool
+	IgnoreValueWhitespace   bool
+	CollapseValueWhitespace bool
+	NoPager                 bool
+	Paginate                bool
+	NoKeyCheck              bool
+	StripSopsMeta           bool
+	Patch                   bool
+	Reverse                 bool
+	Timeout                 time.Duration
+	MaxLines                int
+	SummaryFormat           string
+	NoDecompress            bool
+	AddedOnly               bool
+	RemovedOnly             bool
+	PlaceholderPattern      string
+	EntropyWarn             bool
+	EntropyThreshold        float64
+	Exclude                 []string
+	Verbose                 bool
+	Quiet                   bool
+	ExtensionFormats        map[string]string
+	KeepComments            bool
+	MultilineDiff           bool
+	LengthOnly              bool
+	ValueHash               bool
+	HashSalt                string
+	Colors                  colorScheme
+	Markers                 markerSet
+	ColorMoved              bool
+	PlaintextReference      string
+	NumStat                 bool
+	NameOnly                bool
+	MaxDepth                int
+	MaxFileSize             int64
+	NoLegend                bool
+	ShowUnchanged           bool
+	DiffAlgorithm           string
+	IgnoreWhitespace        bool
+	Offline                 bool
+	Retries                 int
+	AllowFormatMismatch     bool
+	PreserveOrder           bool
+	NoSort                  bool
+	ExpandJSONStrings       bool
+	InputType               string
+	Schema                  *gojsonschema.Schema
+	SchemaStrict            bool
+	Doc                     int
+	// NameOnlyPath is printed by --name-only instead of the changed keys
+	// when the files differ, so directory mode lists changed files
+	NameOnlyPath string
 }
 
 func main() {
@@ -60,23 +215,261 @@ Examples:
   sops-diff secret1.enc.yaml secret2.enc.yaml
   sops-diff --summary secret1.enc.yaml secret2.enc.yaml
   sops-diff HEAD:secrets.enc.yaml secrets.enc.yaml
+  sops-diff --git HEAD~1 HEAD secrets.enc.yaml
   sops-diff --format=json secret1.enc.json secret2.enc.json
   sops-diff --format=env config1.env config2.env
 `,
-		Version:            Version,
+		Version:            versionString(),
 		DisableFlagParsing: false,
 		TraverseChildren:   true,
 		// NOTE: Changed from ExactArgs(2) to handle Git diff arguments
 		RunE: func(cmd *cobra.Command, args []string) error {
 			options := DiffOptions{
-				SummaryMode:      summaryMode,
-				OutputFormat:     outputFormat,
-				ColorOutput:      colorOutput,
-				DiffTool:         diffTool,
-				GitConflicts:     gitConflicts,
-				GitSupport:       gitSupport,
-				ErrorOnDecrypted: errorOnDecrypted,
-				OutputFile:       outputFile,
+				SummaryMode:             summaryMode,
+				Both:                    bothMode,
+				KeysOnly:                keysOnly,
+				SummaryOut:              summaryOut,
+				ColorMoved:              colorMoved,
+				PlaintextReference:      plaintextRef,
+				OutputFormat:            outputFormat,
+				ColorOutput:             colorMode != colorNever,
+				ForceColor:              colorMode == colorAlways,
+				DiffTool:                diffTool,
+				GitConflicts:            gitConflicts,
+				GitSupport:              gitSupport,
+				ErrorOnDecrypted:        errorOnDecrypted,
+				OutputFile:              outputFile,
+				Cache:                   useCache,
+				CacheDir:                cacheDir,
+				AWSProfile:              awsProfile,
+				AWSRegion:               awsRegion,
+				AgeKeyFile:              ageKeyFile,
+				AgeKey:                  ageKey,
+				SopsBinary:              sopsBinary,
+				K8sSecret:               k8sSecret,
+				PathStyle:               pathStyle,
+				WarnDuplicates:          warnDuplicates,
+				ErrorDuplicates:         errorDuplicates,
+				IgnoreKeyCase:           ignoreKeyCase,
+				IgnoreValueWhitespace:   ignoreValueWS,
+				CollapseValueWhitespace: collapseValueWS,
+				NoPager:                 noPager,
+				Paginate:                paginate,
+				NoKeyCheck:              noKeyCheck,
+				StripSopsMeta:           stripSopsMeta,
+				Patch:                   patchOutput,
+				Reverse:                 reverseDiff,
+				Timeout:                 fetchTimeout,
+				MaxLines:                maxLines,
+				SummaryFormat:           summaryFormat,
+				NoDecompress:            noDecompress,
+				AddedOnly:               addedOnly,
+				RemovedOnly:             removedOnly,
+				PlaceholderPattern:      placeholderRegex,
+				EntropyWarn:             entropyWarn,
+				EntropyThreshold:        entropyThreshold,
+				Exclude:                 excludePatterns,
+				Verbose:                 verbose,
+				Quiet:                   quiet,
+				KeepComments:            keepComments,
+				MultilineDiff:           multilineDiff,
+				LengthOnly:              lengthOnly,
+				ValueHash:               valueHash,
+				HashSalt:                hashSalt,
+				NumStat:                 numStat,
+				NameOnly:                nameOnly,
+				MaxDepth:                maxDepth,
+				NoLegend:                noLegend,
+				ShowUnchanged:           showUnchanged,
+				DiffAlgorithm:           diffAlgorithm,
+				IgnoreWhitespace:        ignoreWS,
+				Offline:                 offline,
+				Retries:                 retries,
+				AllowFormatMismatch:     allowMismatch,
+				PreserveOrder:           preserveOrder,
+				NoSort:                  noSort,
+				ExpandJSONStrings:       expandJSON,
+				InputType:               inputType,
+				Decryptor:               decryptor,
+				SchemaStrict:            schemaStrict,
+				Doc:                     docIndex,
+			}
+
+			formats, err := parseExtensionMap(extensionMap)
+			if err != nil {
+				return err
+			}
+			options.ExtensionFormats = formats
+
+			options.Colors, err = newColorScheme(palette, colorAdded, colorRemoved, colorModified, colorHeader)
+			if err != nil {
+				return err
+			}
+
+			options.Markers, err = newMarkerSet(markerAdded, markerRemoved, markerModified)
+			if err != nil {
+				return err
+			}
+
+			options.MaxFileSize, err = parseByteSize(maxFileSize)
+			if err != nil {
+				return err
+			}
+
+			if err := checkDecryptor(options.Decryptor); err != nil {
+				return err
+			}
+
+			if options.PathStyle != pathStyleDot && options.PathStyle != pathStylePointer {
+				return fmt.Errorf("invalid --path-style %q: must be dot or pointer", options.PathStyle)
+			}
+
+			if _, err := regexp.Compile(options.PlaceholderPattern); err != nil {
+				return fmt.Errorf("invalid --placeholder-pattern: %w", err)
+			}
+
+			if options.EntropyThreshold < 0 {
+				return fmt.Errorf("invalid --entropy-threshold %v: must not be negative", options.EntropyThreshold)
+			}
+
+			switch options.DiffAlgorithm {
+			case diffAlgorithmMyers, diffAlgorithmPatience, diffAlgorithmHistogram:
+			default:
+				return fmt.Errorf("invalid --diff-algorithm %q: must be %s, %s or %s", options.DiffAlgorithm, diffAlgorithmMyers, diffAlgorithmPatience, diffAlgorithmHistogram)
+			}
+
+			if options.MaxDepth < 0 {
+				return fmt.Errorf("invalid --max-depth %d: must not be negative", options.MaxDepth)
+			}
+
+			if options.Retries < 0 {
+				return fmt.Errorf("invalid --retries %d: must not be negative", options.Retries)
+			}
+
+			if options.Paginate && options.NoPager {
+				return fmt.Errorf("--paginate cannot be combined with --no-pager")
+			}
+
+			if options.Doc < -1 {
+				return fmt.Errorf("invalid --doc %d: must be a document index, counting from 0", options.Doc)
+			}
+
+			if schemaPath != "" {
+				options.Schema, err = loadSchema(schemaPath)
+				if err != nil {
+					return err
+				}
+			} else if options.SchemaStrict {
+				return fmt.Errorf("--schema-strict requires --schema")
+			}
+
+			switch options.InputType {
+			case "", "yaml", "json", "env", "xml", "ndjson", "plist", "binary":
+			default:
+				return fmt.Errorf("invalid --input-type %q: must be yaml, json, env, xml, ndjson, plist or binary", options.InputType)
+			}
+
+			if (options.NumStat || options.NameOnly) && (options.Patch || options.DiffTool != "") {
+				return fmt.Errorf("--numstat and --name-only cannot be combined with --patch or --diff-tool")
+			}
+
+			if options.NumStat && options.NameOnly {
+				return fmt.Errorf("--numstat cannot be combined with --name-only")
+			}
+
+			// Filtering by change kind, value lengths and hashes only apply to
+			// the list of keys
+			if options.NumStat || options.NameOnly || options.AddedOnly || options.RemovedOnly || options.LengthOnly || options.ValueHash || options.NoLegend || options.ShowUnchanged {
+				options.SummaryMode = true
+			}
+
+			if options.SummaryFormat != summaryFormatFlat && options.SummaryFormat != summaryFormatTree {
+				return fmt.Errorf("invalid --summary-format %q: must be flat or tree", options.SummaryFormat)
+			}
+
+			// Decoded Secret data is re-rendered, so its comments cannot be kept
+			if options.KeepComments && options.K8sSecret {
+				return fmt.Errorf("--keep-comments cannot be combined with --k8s-secret")
+			}
+
+			// Stubbed values would make a patch unappliable, and kept comments
+			// already render block values line by line
+			if options.MultilineDiff && (options.Patch || options.KeepComments) {
+				return fmt.Errorf("--multiline-diff cannot be combined with --patch or --keep-comments")
+			}
+			if options.MultilineDiff && options.PreserveOrder {
+				return fmt.Errorf("--multiline-diff cannot be combined with --preserve-order")
+			}
+
+			// Both render the decrypted files as they are, metadata included
+			if options.StripSopsMeta && (options.KeepComments || options.PreserveOrder) {
+				return fmt.Errorf("--strip-sops-meta cannot be combined with --keep-comments or --preserve-order")
+			}
+			if options.ExpandJSONStrings && (options.KeepComments || options.PreserveOrder) {
+				return fmt.Errorf("--expand-json-strings cannot be combined with --keep-comments or --preserve-order")
+			}
+
+			if options.Patch && (options.SummaryMode || options.DiffTool != "") {
+				return fmt.Errorf("--patch cannot be combined with --summary or --diff-tool")
+			}
+
+			if options.KeysOnly && (options.SummaryMode || options.Both || options.Patch || options.DiffTool != "") {
+				return fmt.Errorf("--keys-only cannot be combined with --summary, the options that imply it, --both, --patch or --diff-tool")
+			}
+
+			if options.Both && (options.SummaryMode || options.Patch || options.DiffTool != "") {
+				return fmt.Errorf("--both cannot be combined with --summary, the options that imply it, --patch or --diff-tool")
+			}
+
+			if options.SummaryOut != "" && (options.KeysOnly || options.Patch || options.DiffTool != "") {
+				return fmt.Errorf("--summary-out cannot be combined with --keys-only, --patch or --diff-tool")
+			}
+
+			// Files never get color codes, even with --color=always
+			if options.OutputFile != "" {
+				options.ColorOutput = false
+			}
+
+			// A truncated patch would not apply
+			if options.Patch && options.MaxLines > 0 {
+				return fmt.Errorf("--max-lines cannot be combined with --patch")
+			}
+
+			// Neither would one that skips whitespace changes
+			if options.Patch && options.IgnoreWhitespace {
+				return fmt.Errorf("--ignore-whitespace cannot be combined with --patch")
+			}
+
+			// Compare the staged version of a file with the working tree
+			if stagedMode {
+				if len(args) != 1 {
+					return fmt.Errorf("--staged accepts 1 arg(s), received %d", len(args))
+				}
+				stagedRef, err := gitStagedRef(args[0])
+				if err != nil {
+					return err
+				}
+				options.GitSupport = true
+				return runDiff(stagedRef, args[0], options)
+			}
+
+			// Compare one path at two Git revisions
+			if len(gitRevs) > 0 || (gitSupport && len(args) == 3) {
+				file1, file2, err := gitRevisionRefs(gitRevs, args)
+				if err != nil {
+					return err
+				}
+				options.GitSupport = true
+				return runDiff(file1, file2, options)
+			}
+
+			// Expand quoted glob patterns, e.g. when the shell did not (Windows)
+			if !(gitSupport && len(args) >= 7) {
+				expanded, err := expandGlobs(args)
+				if err != nil {
+					return err
+				}
+				args = expanded
 			}
 
 			// Check for the first arg that doesn't start with "-" to determine if it's a subcommand
@@ -116,29 +509,147 @@ Examples:
 				return fmt.Errorf("accepts 2 arg(s), received %d", len(args))
 			}
 
+			if watchMode {
+				return watchDiff(args[0], args[1], options)
+			}
+
+			if isDirectory(args[0]) && isDirectory(args[1]) {
+				return diffDirectories(args[0], args[1], options)
+			}
+
 			return runDiff(args[0], args[1], options)
 		},
 	}
 
 	// Define flags
 	rootCmd.Flags().BoolVarP(&summaryMode, "summary", "s", false, "Display only keys that have changed, without sensitive values")
-	rootCmd.Flags().StringVarP(&outputFormat, "format", "f", "auto", "Output format: auto, yaml, json, env")
-	rootCmd.Flags().BoolVarP(&colorOutput, "color", "c", true, "Use colored output when supported")
+	rootCmd.Flags().BoolVar(&keysOnly, "keys-only", false, "Diff the lists of keys of both files, with the type of each value but never the values")
+	rootCmd.Flags().BoolVar(&bothMode, "both", false, "Display the summary of changed keys followed by the full diff")
+	rootCmd.Flags().StringVarP(&outputFormat, "format", "f", "auto", "Output format: auto, yaml, json, env, xml, ndjson, plist, binary")
+	rootCmd.Flags().StringVar(&inputType, "input-type", "", "Format the files are decrypted and parsed as, when --format should only set the rendering: yaml, json, env, xml, ndjson, plist, binary")
+	rootCmd.PersistentFlags().VarP(&colorMode, "color", "c", "Color output: auto (when stdout is a terminal and NO_COLOR is unset), always or never")
+	rootCmd.PersistentFlags().Lookup("color").NoOptDefVal = colorAuto
 	rootCmd.Flags().StringVarP(&diffTool, "diff-tool", "d", "", "Use an external diff tool (e.g. 'vimdiff')")
 	rootCmd.Flags().BoolVarP(&gitSupport, "git", "g", false, "Enable Git revision comparison support")
 	rootCmd.Flags().BoolVar(&errorOnDecrypted, "error-on-decrypted", true, "Return error if any file is found to be decrypted")
 	rootCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Save output to file instead of printing to stdout")
+	rootCmd.Flags().StringVar(&summaryOut, "summary-out", "", "Also save the summary of changed keys to a file, or instead of stdout with --summary")
+	rootCmd.PersistentFlags().BoolVar(&useCache, "cache", false, "Cache decrypted content by ciphertext hash (stores plaintext, use a tmpfs --cache-dir)")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "Directory for the decryption cache (default $XDG_RUNTIME_DIR/sops-diff)")
+	rootCmd.PersistentFlags().StringVar(&awsProfile, "aws-profile", "", "AWS profile used for KMS decryption of both files")
+	rootCmd.PersistentFlags().StringVar(&awsRegion, "aws-region", "", "AWS region used for KMS decryption of both files")
+	rootCmd.PersistentFlags().StringVar(&ageKeyFile, "age-key-file", "", "Path to the age identity file used for decryption (sets SOPS_AGE_KEY_FILE)")
+	rootCmd.PersistentFlags().StringVar(&ageKey, "age-key", "", "age identity used for decryption (sets SOPS_AGE_KEY; visible in the process list)")
+	rootCmd.PersistentFlags().IntVar(&retries, "retries", 0, "Retry decryption up to N times with exponential backoff on throttling and timeout errors")
+	rootCmd.PersistentFlags().BoolVar(&offline, "offline", false, "Fail fast on files that need AWS/GCP/Azure KMS or Vault to decrypt, and never contact them")
+	rootCmd.Flags().BoolVar(&noKeyCheck, "no-key-check", false, "Do not warn when the two files are encrypted to different keys")
+	rootCmd.Flags().StringVar(&plaintextRef, "plaintext-reference", "", "One of the two files that is intentionally plaintext, such as a template: it is parsed without decryption or warnings")
+	rootCmd.Flags().BoolVar(&stripSopsMeta, "strip-sops-meta", false, "Ignore the sops metadata key of files that still carry it, such as a file decrypted in place")
+	rootCmd.Flags().BoolVar(&k8sSecret, "k8s-secret", false, "Base64-decode the data values of Kubernetes Secret manifests before comparing")
+	rootCmd.Flags().StringVar(&pathStyle, "path-style", pathStyleDot, "Notation for flattened key paths: dot or pointer (RFC 6901 JSON Pointer)")
+	rootCmd.Flags().BoolVar(&warnDuplicates, "warn-duplicates", false, "Warn about keys defined more than once in a file")
+	rootCmd.Flags().BoolVar(&errorDuplicates, "error-duplicates", false, "Return error if a file defines a key more than once")
+	rootCmd.Flags().BoolVar(&ignoreKeyCase, "ignore-key-case", false, "Compare keys case-insensitively (e.g. DB_HOST and db_host)")
+	rootCmd.Flags().BoolVar(&ignoreValueWS, "ignore-value-whitespace", false, "Ignore leading and trailing whitespace when comparing values")
+	rootCmd.Flags().BoolVar(&collapseValueWS, "collapse-value-whitespace", false, "Also treat runs of spaces and tabs inside values as a single space")
+	rootCmd.Flags().BoolVar(&noPager, "no-pager", false, "Do not pipe long output through a pager")
+	rootCmd.Flags().BoolVar(&paginate, "paginate", false, "Pipe output through a pager even when it fits on the screen, if stdout is a terminal")
+	rootCmd.Flags().BoolVar(&patchOutput, "patch", false, "Output a git-style patch of the decrypted content")
+	rootCmd.Flags().BoolVarP(&reverseDiff, "reverse", "R", false, "Swap the two inputs and show the diff in the other direction")
+	rootCmd.Flags().DurationVar(&fetchTimeout, "timeout", 30*time.Second, "Timeout for fetching inputs from HTTP(S) URLs and S3")
+	rootCmd.Flags().BoolVarP(&watchMode, "watch", "w", false, "Re-run the diff whenever either input file changes")
+	rootCmd.Flags().StringArrayVar(&gitRevs, "git-rev", nil, "Git revision to compare a single path at (give twice: old, then new)")
+	rootCmd.Flags().BoolVar(&stagedMode, "staged", false, "Compare the version of a file staged in the Git index with the working tree")
+	rootCmd.Flags().IntVar(&maxLines, "max-lines", 0, "Truncate the diff after N lines, or the summary after N keys (0 for no limit)")
+	rootCmd.Flags().StringVar(&summaryFormat, "summary-format", summaryFormatFlat, "Rendering of changed keys in summary mode: flat or tree")
+	rootCmd.Flags().BoolVar(&noDecompress, "no-decompress", false, "Do not decompress gzip-compressed input files")
+	rootCmd.Flags().BoolVar(&addedOnly, "added-only", false, "Only list added keys (implies --summary)")
+	rootCmd.Flags().BoolVar(&removedOnly, "removed-only", false, "Only list removed keys (implies --summary)")
+	rootCmd.Flags().StringVar(&placeholderRegex, "placeholder-pattern", defaultPlaceholderPattern, "Regular expression for placeholder values to warn about when a key is modified")
+	rootCmd.Flags().BoolVar(&entropyWarn, "entropy-warn", false, "Warn about added or modified values with low Shannon entropy")
+	rootCmd.Flags().Float64Var(&entropyThreshold, "entropy-threshold", defaultEntropyThreshold, "Total Shannon entropy of a value, in bits, below which --entropy-warn reports it")
+	rootCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Skip files matching a glob when comparing directories (can be repeated)")
+	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Report skipped files when comparing directories, formats detected from content and skipped decryption")
+	rootCmd.Flags().BoolVar(&quiet, "quiet", false, "Do not show the progress spinner while files are decrypted")
+	rootCmd.Flags().BoolVar(&allowMismatch, "allow-format-mismatch", false, "Compare files of different formats (e.g. JSON and YAML) key by key, each decrypted as its own format")
+	rootCmd.Flags().StringToStringVar(&extensionMap, "ext-map", nil, "Formats for nonstandard file extensions, e.g. .conf=json,.secret=yaml")
+	rootCmd.Flags().BoolVar(&keepComments, "keep-comments", false, "Keep comments and key order of YAML files in the full diff")
+	rootCmd.Flags().BoolVar(&preserveOrder, "preserve-order", false, "Keep the member order of JSON files in the full diff instead of sorting keys")
+	rootCmd.Flags().BoolVar(&noSort, "no-sort", false, "Keep the variable order of ENV files in the full diff instead of sorting keys")
+	rootCmd.Flags().BoolVar(&multilineDiff, "multiline-diff", false, "Diff changed multi-line values line by line under their key in the full diff")
+	rootCmd.Flags().BoolVar(&expandJSON, "expand-json-strings", false, "Pretty-print string values holding a JSON object or array, so their changes show line by line")
+	rootCmd.Flags().BoolVar(&lengthOnly, "length-only", false, "Show the old and new length of modified values instead of the values (implies --summary)")
+	rootCmd.Flags().BoolVar(&valueHash, "value-hash", false, "Show a short hash of the old and new value of each changed key (implies --summary)")
+	rootCmd.Flags().StringVar(&hashSalt, "hash-salt", "", "Secret salt for --value-hash, hashing with HMAC-SHA256 instead of plain SHA-256")
+	rootCmd.Flags().BoolVar(&numStat, "numstat", false, "Print the number of added, removed and modified keys and the path, tab-separated")
+	rootCmd.Flags().BoolVar(&nameOnly, "name-only", false, "Only list the top-level keys that contain changes, or the changed files when comparing directories")
+	rootCmd.Flags().BoolVar(&ignoreWS, "ignore-whitespace", false, "Treat lines that differ only in whitespace as unchanged in the full diff, like diff -w")
+	rootCmd.Flags().StringVar(&diffAlgorithm, "diff-algorithm", diffAlgorithmMyers, "Line diff algorithm for the full diff: myers, patience or histogram")
+	rootCmd.Flags().BoolVar(&showUnchanged, "show-unchanged", false, "Also list keys that are equal in both files, marked with =, for a complete manifest (implies --summary)")
+	rootCmd.Flags().StringVar(&markerAdded, "marker-added", changeAdded, "Marker of added keys in the summary")
+	rootCmd.Flags().StringVar(&markerRemoved, "marker-removed", changeRemoved, "Marker of removed keys in the summary")
+	rootCmd.Flags().StringVar(&markerModified, "marker-modified", changeModified, "Marker of modified keys in the summary")
+	rootCmd.Flags().BoolVar(&noLegend, "no-legend", false, "Print only the summary change lines, tab-separated, without header, legend or \"No changes detected\" (implies --summary)")
+	rootCmd.Flags().IntVar(&docIndex, "doc", -1, "Compare only the document at index N, counting from 0, of multi-document YAML files (-1 for the first)")
+	rootCmd.Flags().StringVar(&schemaPath, "schema", "", "Validate both decrypted YAML or JSON documents against a JSON schema and warn about violations")
+	rootCmd.Flags().BoolVar(&schemaStrict, "schema-strict", false, "Return error if a document does not match the --schema")
+	rootCmd.PersistentFlags().IntVar(&maxDepth, "max-depth", defaultMaxDepth, "Abort when a decrypted document nests maps and lists deeper than N levels (0 for no limit)")
+	rootCmd.PersistentFlags().StringVar(&sopsBinary, "sops-bin", "sops", "Path to the sops binary used to encrypt merge results and by --decryptor=binary")
+	rootCmd.PersistentFlags().StringVar(&decryptor, "decryptor", decryptorAuto, "Decrypt with the built-in SOPS library or the sops binary: auto (the binary for PGP files, when installed), library or binary")
+	rootCmd.PersistentFlags().StringVar(&palette, "palette", paletteDefault, "Color preset: default, or colorblind for blue and orange")
+	rootCmd.PersistentFlags().StringVar(&colorAdded, "color-added", "", "Color of added lines: a name such as green or bright-blue, or a 256-color code")
+	rootCmd.PersistentFlags().StringVar(&colorRemoved, "color-removed", "", "Color of removed lines and keys: a name such as bold-red, or a 256-color code")
+	rootCmd.PersistentFlags().StringVar(&colorModified, "color-modified", "", "Color of modified keys in the summary: a name such as yellow, or a 256-color code")
+	rootCmd.PersistentFlags().StringVar(&colorHeader, "color-header", "", "Color of hunk headers and conflict markers: a name or a 256-color code")
+	rootCmd.Flags().BoolVar(&colorMoved, "color-moved", false, "Dim removed and added diff lines that only moved, so real changes stand out")
+	rootCmd.PersistentFlags().StringVar(&maxFileSize, "max-file-size", defaultMaxFileSize, "Refuse inputs larger than this, e.g. 10M or 1GiB (0 for no limit)")
+
+	// Print version in the same format for both --version and the version subcommand
+	rootCmd.SetVersionTemplate("sops-diff {{.Version}}\n")
+
+	// Add a version command
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print version, commit, build date and Go runtime version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("sops-diff %s\n", versionString())
+		},
+	}
+	rootCmd.AddCommand(versionCmd)
 
 	// Add a setup-git-merge-tool command
 	setupGitCmd := &cobra.Command{
 		Use:   "setup-git-merge-tool",
 		Short: "Configure Git to use sops-diff for merge conflict resolution",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return SetupGitMergeTool()
+			textconv, _ := cmd.Flags().GetBool("textconv")
+			return SetupGitMergeTool(textconv)
 		},
 	}
+	setupGitCmd.Flags().Bool("textconv", false, "Also configure sops-diff textconv so git diff and git log -p show decrypted values")
 	rootCmd.AddCommand(setupGitCmd)
 
+	// Add a textconv command, used as a Git diff textconv filter
+	textconvCmd := &cobra.Command{
+		Use:   "textconv FILE",
+		Short: "Decrypt a file to stdout (used as a Git textconv filter)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options, err := subcommandOptions()
+			if err != nil {
+				return err
+			}
+			if err := checkDecryptor(options.Decryptor); err != nil {
+				return err
+			}
+
+			options.OutputFormat = "auto"
+			return TextConv(args[0], options)
+		},
+	}
+	rootCmd.AddCommand(textconvCmd)
+
 	// Add a git-conflicts command
 	conflictsCmd := &cobra.Command{
 		Use:   "git-conflicts FILE",
@@ -147,186 +658,696 @@ Examples:
 		RunE: func(cmd *cobra.Command, args []string) error {
 			localOutputFile, _ := cmd.Flags().GetString("output")
 
-			options := DiffOptions{
-				SummaryMode:      summaryMode,
-				OutputFormat:     outputFormat,
-				ColorOutput:      colorOutput,
-				DiffTool:         diffTool,
-				GitSupport:       gitSupport,
-				ErrorOnDecrypted: errorOnDecrypted,
-				GitConflicts:     true,
-				OutputFile:       localOutputFile,
+			options, err := subcommandOptions()
+			if err != nil {
+				return err
+			}
+			options.SummaryMode = summaryMode
+			options.OutputFormat = outputFormat
+			options.ColorOutput = colorMode != colorNever
+			options.ForceColor = colorMode == colorAlways
+			options.DiffTool = diffTool
+			options.GitSupport = gitSupport
+			options.ErrorOnDecrypted = errorOnDecrypted
+			options.GitConflicts = true
+			options.OutputFile = localOutputFile
+
+			options.Colors, err = newColorScheme(palette, colorAdded, colorRemoved, colorModified, colorHeader)
+			if err != nil {
+				return err
 			}
 
+			if useBinary, _ := cmd.Flags().GetBool("use-sops-binary"); useBinary {
+				options.Decryptor = decryptorBinary
+			}
+			if err := checkDecryptor(options.Decryptor); err != nil {
+				return err
+			}
 			viewAsDiff, _ := cmd.Flags().GetBool("view-as-diff")
+			interactive, _ := cmd.Flags().GetBool("interactive")
+			if interactive && viewAsDiff {
+				return fmt.Errorf("--interactive cannot be combined with --view-as-diff")
+			}
 
-			return HandleGitConflicts(args[0], options, viewAsDiff)
+			return HandleGitConflicts(args[0], options, viewAsDiff, interactive)
 		},
 	}
 	conflictsCmd.Flags().StringP("output", "o", "", "Save output to file instead of printing to stdout")
 	conflictsCmd.Flags().Bool("view-as-diff", false, "View as git diff")
+	conflictsCmd.Flags().Bool("interactive", false, "Choose ours, theirs or a new value for each conflicting key, then re-encrypt the file")
+	conflictsCmd.Flags().Bool("use-sops-binary", false, "Decrypt with the sops binary instead of the built-in SOPS library (same as --decryptor=binary)")
 	rootCmd.AddCommand(conflictsCmd)
 
+	// Add a git-merge command, used by the merge driver and merge tool
+	gitMergeCmd := &cobra.Command{
+		Use:   "git-merge LOCAL BASE REMOTE MERGED",
+		Short: "Merge SOPS-encrypted files (used by the Git merge tool)",
+		Args:  cobra.ExactArgs(4),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			localDiffTool, _ := cmd.Flags().GetString("diff-tool")
+
+			options, err := subcommandOptions()
+			if err != nil {
+				return err
+			}
+			options.OutputFormat = outputFormat
+			options.ColorOutput = colorMode != colorNever
+			options.ForceColor = colorMode == colorAlways
+			options.DiffTool = localDiffTool
+
+			options.Colors, err = newColorScheme(palette, colorAdded, colorRemoved, colorModified, colorHeader)
+			if err != nil {
+				return err
+			}
+
+			if err := checkDecryptor(options.Decryptor); err != nil {
+				return err
+			}
+
+			output := args[3]
+			if driver, _ := cmd.Flags().GetBool("driver"); driver {
+				output = args[0]
+			}
+
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			return HandleGitMerge(args[0], args[1], args[2], args[3], output, options, dryRun)
+		},
+	}
+	gitMergeCmd.Flags().StringP("diff-tool", "d", "", "Editor or merge tool used when both sides changed")
+	gitMergeCmd.Flags().Bool("dry-run", false, "Print the merged plaintext, or the conflicts left, without encrypting or writing MERGED")
+	gitMergeCmd.Flags().Bool("driver", false, "Run as a Git merge driver: write the result to LOCAL (%A), which Git keeps, and use MERGED (%P) only for its name")
+	rootCmd.AddCommand(gitMergeCmd)
+
+	// Add a hidden gen-man command, used when packaging
+	genManCmd := &cobra.Command{
+		Use:    "gen-man DIR",
+		Short:  "Write roff man pages for sops-diff and its commands to DIR",
+		Args:   cobra.ExactArgs(1),
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := os.MkdirAll(args[0], 0755); err != nil {
+				return fmt.Errorf("error creating %s: %w", args[0], err)
+			}
+
+			// Leave out the dated "Auto generated" footer so package builds are
+			// reproducible; the header date honours SOURCE_DATE_EPOCH
+			rootCmd.DisableAutoGenTag = true
+			header := &doc.GenManHeader{
+				Title:   "SOPS-DIFF",
+				Section: "1",
+				Source:  "sops-diff " + Version,
+				Manual:  "sops-diff manual",
+			}
+			if err := doc.GenManTree(rootCmd, header, args[0]); err != nil {
+				return fmt.Errorf("error writing man pages: %w", err)
+			}
+			return nil
+		},
+	}
+	rootCmd.AddCommand(genManCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
+// versionString renders the version together with the build metadata
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s/%s)",
+		Version, CommitSHA, BuildTime, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// subcommandOptions builds the decryption settings shared by textconv,
+// git-conflicts and git-merge from the persistent flags, so every
+// subcommand decrypts the way the root command does
+func subcommandOptions() (DiffOptions, error) {
+	options := DiffOptions{
+		Cache:      useCache,
+		CacheDir:   cacheDir,
+		SopsBinary: sopsBinary,
+		Decryptor:  decryptor,
+		Offline:    offline,
+		Retries:    retries,
+		Verbose:    verbose,
+		AWSProfile: awsProfile,
+		AWSRegion:  awsRegion,
+		AgeKeyFile: ageKeyFile,
+		AgeKey:     ageKey,
+		MaxDepth:   maxDepth,
+	}
+
+	var err error
+	options.MaxFileSize, err = parseByteSize(maxFileSize)
+	if err != nil {
+		return options, err
+	}
+
+	if options.MaxDepth < 0 {
+		return options, fmt.Errorf("invalid --max-depth %d: must not be negative", options.MaxDepth)
+	}
+
+	return options, nil
+}
+
+// Kinds of key changes reported in summary mode, using their summary markers
+const (
+	changeModified  = "!"
+	changeAdded     = "+"
+	changeRemoved   = "-"
+	changeUnchanged = "="
+)
+
+// nullValue marks a key explicitly set to null, so it is not conflated
+// with a missing key or an empty string
+type nullValue = sopsdiff.Null
+
+// keyChange describes a single key that differs between the two files
+type keyChange struct {
+	Kind     string
+	Key      string
+	OldValue interface{}
+	NewValue interface{}
+}
+
 // Compare two sets of data and show only changed keys
-func compareData(data1, data2 interface{}) (string, error) {
+func compareData(data1, data2 interface{}, options DiffOptions) (string, error) {
+	return summarizeResult(Compare(data1, data2, options), options), nil
+}
+
+// Compare two env files and show only changed keys
+func compareEnvData(data1, data2 envFile, options DiffOptions) (string, error) {
 	flat1 := make(map[string]interface{})
 	flat2 := make(map[string]interface{})
 
-	flatten(data1, "", flat1)
-	flatten(data2, "", flat2)
+	for _, k := range data1.Keys {
+		flat1[sopsdiff.JoinKeyPath("", k, options.PathStyle)] = data1.Values[k]
+	}
+	for _, k := range data2.Keys {
+		flat2[sopsdiff.JoinKeyPath("", k, options.PathStyle)] = data2.Values[k]
+	}
 
-	var changed []string
+	return summarizeChanges(flat1, flat2, options), nil
+}
+
+// summarizeChanges classifies the changes between two flattened documents
+// and renders the summary lines
+func summarizeChanges(flat1, flat2 map[string]interface{}, options DiffOptions) string {
+	return summarizeResult(compareFlat(flat1, flat2, options), options)
+}
+
+// summarizeResult renders the summary lines of a comparison
+func summarizeResult(result DiffResult, options DiffOptions) string {
+	return renderChanges(filterChanges(result, options).changes(), options)
+}
+
+// unchangedKeys lists the keys of the first document that are not among its
+// changes, so they are present and equal in both documents
+func unchangedKeys(flat1 map[string]interface{}, changes []keyChange) []keyChange {
+	changed := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		changed[change.Key] = true
+	}
+
+	var unchanged []keyChange
+	for k, v := range flat1 {
+		if !changed[k] {
+			unchanged = append(unchanged, keyChange{Kind: changeUnchanged, Key: k, OldValue: v, NewValue: v})
+		}
+	}
+	return unchanged
+}
+
+// filterChanges keeps only added keys with --added-only, and only removed
+// keys with --removed-only
+func filterChanges(result DiffResult, options DiffOptions) DiffResult {
+	if !options.AddedOnly && !options.RemovedOnly {
+		return result
+	}
+
+	filtered := DiffResult{Values: result.Values}
+	if options.AddedOnly {
+		filtered.Added = result.Added
+	}
+	if options.RemovedOnly {
+		filtered.Removed = result.Removed
+	}
+	return filtered
+}
+
+// diffFlatMaps classifies the keys of two flattened documents as modified,
+// added or removed
+func diffFlatMaps(flat1, flat2 map[string]interface{}, options DiffOptions) []keyChange {
+	// Display names keep the original casing, preferring the first file
+	names := make(map[string]string)
+	if options.IgnoreKeyCase {
+		flat2 = foldKeyCase(flat2, names)
+		flat1 = foldKeyCase(flat1, names)
+	}
+	displayName := func(k string) string {
+		if name, ok := names[k]; ok {
+			return name
+		}
+		return k
+	}
+
+	var changes []keyChange
 
 	// Find keys that exist in data1 but not in data2 or have different values
 	for k, v1 := range flat1 {
 		if v2, exists := flat2[k]; !exists {
-			changed = append(changed, fmt.Sprintf("- %s", k))
-		} else if fmt.Sprintf("%v", v1) != fmt.Sprintf("%v", v2) {
-			changed = append(changed, fmt.Sprintf("! %s", k))
+			changes = append(changes, keyChange{Kind: changeRemoved, Key: displayName(k), OldValue: v1})
+		} else if !valuesEqual(normalizeValue(v1, options), normalizeValue(v2, options)) {
+			changes = append(changes, keyChange{Kind: changeModified, Key: displayName(k), OldValue: v1, NewValue: v2})
 		}
 	}
 
 	// Find keys that exist in data2 but not in data1
-	for k := range flat2 {
+	for k, v2 := range flat2 {
 		if _, exists := flat1[k]; !exists {
-			changed = append(changed, fmt.Sprintf("+ %s", k))
+			changes = append(changes, keyChange{Kind: changeAdded, Key: displayName(k), NewValue: v2})
 		}
 	}
 
-	sort.Strings(changed)
+	return changes
+}
 
-	var buffer strings.Builder
-	for _, line := range changed {
-		buffer.WriteString(line)
-		buffer.WriteString("\n")
+// foldKeyCase re-keys a flattened document by lower-cased key, recording the
+// original key of each entry in names (later calls overwrite earlier ones)
+func foldKeyCase(flat map[string]interface{}, names map[string]string) map[string]interface{} {
+	folded := make(map[string]interface{}, len(flat))
+	for k, v := range flat {
+		lower := strings.ToLower(k)
+		folded[lower] = v
+		names[lower] = k
 	}
+	return folded
+}
 
-	return buffer.String(), nil
+// horizontalWhitespace matches runs of spaces and tabs within a line
+var horizontalWhitespace = regexp.MustCompile(`[ \t]+`)
+
+// normalizeValue applies the whitespace-insensitive comparison options to a
+// string value. Line breaks are kept so multi-line values such as PEM blocks
+// still compare line by line.
+func normalizeValue(v interface{}, options DiffOptions) interface{} {
+	str, ok := v.(string)
+	if !ok || (!options.IgnoreValueWhitespace && !options.CollapseValueWhitespace) {
+		return v
+	}
+
+	if options.CollapseValueWhitespace {
+		lines := strings.Split(strings.ReplaceAll(str, "\r\n", "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace(horizontalWhitespace.ReplaceAllString(line, " "))
+		}
+		str = strings.Join(lines, "\n")
+	}
+
+	return strings.TrimSpace(str)
 }
 
-// Compare two env files and show only changed keys
-func compareEnvData(data1, data2 map[string]string) (string, error) {
-	var changed []string
+// valuesEqual compares two flattened leaf values. A null never equals a
+// non-null value, even one that stringifies the same. Maps and lists are
+// compared element by element, so the result never depends on map iteration
+// order. Numbers are compared by value, so 1 equals 1.0, and other scalars by
+// their string form.
+func valuesEqual(v1, v2 interface{}) bool {
+	_, null1 := v1.(nullValue)
+	_, null2 := v2.(nullValue)
+	if null1 || null2 {
+		return null1 && null2
+	}
+	if v1 == nil || v2 == nil {
+		return v1 == nil && v2 == nil
+	}
 
-	// Find keys that exist in data1 but not in data2 or have different values
-	for k, v1 := range data1 {
-		if v2, exists := data2[k]; !exists {
-			changed = append(changed, fmt.Sprintf("- %s", k))
-		} else if v1 != v2 {
-			changed = append(changed, fmt.Sprintf("! %s", k))
+	map1, isMap1 := stringKeyedMap(v1)
+	map2, isMap2 := stringKeyedMap(v2)
+	if isMap1 || isMap2 {
+		if !isMap1 || !isMap2 || len(map1) != len(map2) {
+			return false
+		}
+		for k, val1 := range map1 {
+			val2, ok := map2[k]
+			if !ok || !valuesEqual(val1, val2) {
+				return false
+			}
 		}
+		return true
 	}
 
-	// Find keys that exist in data2 but not in data1
-	for k := range data2 {
-		if _, exists := data1[k]; !exists {
-			changed = append(changed, fmt.Sprintf("+ %s", k))
+	list1, isList1 := v1.([]interface{})
+	list2, isList2 := v2.([]interface{})
+	if isList1 || isList2 {
+		if !isList1 || !isList2 || len(list1) != len(list2) {
+			return false
+		}
+		for i := range list1 {
+			if !valuesEqual(list1[i], list2[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if n1, ok := numericValue(v1); ok {
+		if n2, ok := numericValue(v2); ok {
+			return n1.Cmp(n2) == 0
 		}
 	}
 
-	sort.Strings(changed)
+	return fmt.Sprintf("%v", v1) == fmt.Sprintf("%v", v2)
+}
+
+// stringKeyedMap converts a decoded map to one keyed by strings, the same way
+// flatten names its keys
+func stringKeyedMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(m))
+		for k, val := range m {
+			strKey, ok := k.(string)
+			if !ok {
+				strKey = fmt.Sprintf("%v", k)
+			}
+			result[strKey] = val
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// renderChanges formats key changes as sorted summary lines, or as a tree with
+// --summary-format=tree. Modified keys are annotated when their new value is
+// null or an empty string.
+func renderChanges(changes []keyChange, options DiffOptions) string {
+	if options.SummaryFormat == summaryFormatTree {
+		return renderChangeTree(changes, options)
+	}
+
+	// The marker comes first, followed by a space, or by a tab in the
+	// --no-legend output, which also separates the annotation
+	sep := " "
+	if options.NoLegend {
+		sep = "\t"
+	}
+
+	type summaryLine struct {
+		kind, rest string
+	}
+	var changed []summaryLine
+	for _, change := range changes {
+		line := summaryLine{kind: change.Kind, rest: sep + summaryKey(change.Key)}
+		if annotation := changeAnnotation(change, options); annotation != "" {
+			line.rest += sep + strings.TrimPrefix(annotation, " ")
+		}
+		changed = append(changed, line)
+	}
+
+	// Changes are grouped by kind, in the order of the default markers, but a
+	// manifest that includes unchanged keys reads best in key order
+	sort.Slice(changed, func(i, j int) bool {
+		if !options.ShowUnchanged && changed[i].kind != changed[j].kind {
+			return changed[i].kind < changed[j].kind
+		}
+		return changed[i].rest < changed[j].rest
+	})
 
 	var buffer strings.Builder
 	for _, line := range changed {
-		buffer.WriteString(line)
+		buffer.WriteString(options.Markers.marker(line.kind) + line.rest)
 		buffer.WriteString("\n")
 	}
 
-	return buffer.String(), nil
+	return buffer.String()
+}
+
+// summaryKey renders a key path for a summary line. Keys that would break
+// the line format, with control characters such as tabs or newlines,
+// surrounding spaces or a leading double quote, are shown as quoted Go
+// strings; other keys, including ones starting with a marker character like
+// +feature.enabled, are shown as they are.
+func summaryKey(key string) string {
+	needsQuote := strings.HasPrefix(key, `"`) || strings.TrimSpace(key) != key
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			needsQuote = true
+			break
+		}
+	}
+
+	if needsQuote {
+		return strconv.Quote(key)
+	}
+	return key
+}
+
+// changeAnnotation notes when a modified key was set to null or to an empty
+// string, which are easily mistaken for a removal. Otherwise --length-only
+// adds the length of the old and new value, and --value-hash their hashes.
+func changeAnnotation(change keyChange, options DiffOptions) string {
+	if change.Kind == changeModified {
+		if _, isNull := change.NewValue.(nullValue); isNull {
+			return " (set to null)"
+		} else if change.NewValue == "" {
+			return " (set to empty string)"
+		}
+	}
+
+	var details []string
+	if options.LengthOnly && change.Kind == changeModified {
+		details = append(details, fmt.Sprintf("%d→%d bytes", valueLength(change.OldValue), valueLength(change.NewValue)))
+	}
+	if options.ValueHash {
+		switch change.Kind {
+		case changeModified:
+			details = append(details, hashValue(change.OldValue, options.HashSalt)+"→"+hashValue(change.NewValue, options.HashSalt))
+		case changeAdded:
+			details = append(details, hashValue(change.NewValue, options.HashSalt))
+		case changeRemoved, changeUnchanged:
+			details = append(details, hashValue(change.OldValue, options.HashSalt))
+		}
+	}
+
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
+// valueHashLength is the number of hex digits of a value hash that are shown
+const valueHashLength = 12
+
+// hashValue returns a short hex SHA-256 hash of a value as it is compared,
+// keyed with HMAC when a salt is given so the hash cannot be looked up in a
+// dictionary of common secrets
+func hashValue(v interface{}, salt string) string {
+	value := []byte(fmt.Sprintf("%v", v))
+
+	var sum []byte
+	if salt != "" {
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write(value)
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256(value)
+		sum = digest[:]
+	}
+	return hex.EncodeToString(sum)[:valueHashLength]
+}
+
+// valueLength returns the length in bytes of a value as it is compared
+func valueLength(v interface{}) int {
+	if _, isNull := v.(nullValue); isNull {
+		return 0
+	}
+	return len(fmt.Sprintf("%v", v))
 }
 
 // runDiff is the main function that handles the diff operation
 func runDiff(file1Path, file2Path string, options DiffOptions) error {
+	// Swapping the inputs flips labels, hunks and summary symbols together
+	if options.Reverse {
+		file1Path, file2Path = file2Path, file1Path
+	}
+
 	// Keep all the existing code for reading and decrypting files
 	var file1Content, file2Content []byte
 	var err error
 
 	// Handle Git references if enabled
-	if options.GitSupport && (strings.Contains(file1Path, ":") || strings.Contains(file2Path, ":")) {
-		file1Content, err = readGitFile(file1Path)
-		if err != nil {
-			return fmt.Errorf("error reading Git file %s: %w", file1Path, err)
-		}
+	fromGit := options.GitSupport && (isGitRef(file1Path) || isGitRef(file2Path))
 
-		file2Content, err = readGitFile(file2Path)
-		if err != nil {
-			return fmt.Errorf("error reading Git file %s: %w", file2Path, err)
+	file1Content, err = readInput(file1Path, fromGit, options)
+	if err != nil {
+		return &ReadError{Path: file1Path, Err: err}
+	}
+
+	file2Content, err = readInput(file2Path, fromGit, options)
+	if err != nil {
+		return &ReadError{Path: file2Path, Err: err}
+	}
+
+	// An intentionally plaintext file is never decrypted or warned about
+	reference1 := options.PlaintextReference != "" && file1Path == options.PlaintextReference
+	reference2 := options.PlaintextReference != "" && file2Path == options.PlaintextReference
+	if options.PlaintextReference != "" && !reference1 && !reference2 {
+		return fmt.Errorf("--plaintext-reference %s is neither of the compared files", options.PlaintextReference)
+	}
+	if (reference1 && looksEncrypted(file1Content)) || (reference2 && looksEncrypted(file2Content)) {
+		return fmt.Errorf("--plaintext-reference %s is SOPS-encrypted", options.PlaintextReference)
+	}
+
+	// Determine file format. With --input-type, or --allow-format-mismatch,
+	// files are decrypted in their own format even when --format is given,
+	// which then only sets the rendering.
+	detectOptions := options
+	if options.InputType != "" {
+		detectOptions.OutputFormat = options.InputType
+	} else if options.AllowFormatMismatch {
+		detectOptions.OutputFormat = "auto"
+	}
+	format1 := detectInputFormat(file1Path, file1Content, detectOptions)
+	format2 := detectInputFormat(file2Path, file2Content, detectOptions)
+
+	// Use the explicitly specified format or the detected one
+	format := options.OutputFormat
+	if options.AllowFormatMismatch && format1 != format2 {
+		// Each file is decrypted and parsed as its own format, then converted
+		// to a common one
+		if format == "auto" {
+			format = commonFormat(format1, format2)
 		}
 	} else {
-		// Regular file reading
-		file1Content, err = ioutil.ReadFile(file1Path)
-		if err != nil {
-			return fmt.Errorf("error reading file %s: %w", file1Path, err)
+		if format == "auto" {
+			// If any of the files is .env, use env format
+			if format1 == "env" || format2 == "env" {
+				format = "env"
+			} else if format1 != format2 {
+				return &FormatMismatchError{Format1: format1, Format2: format2}
+			} else {
+				format = format1
+			}
 		}
 
-		file2Content, err = ioutil.ReadFile(file2Path)
-		if err != nil {
-			return fmt.Errorf("error reading file %s: %w", file2Path, err)
+		// --input-type decouples decryption from the rendering format
+		if options.InputType == "" {
+			format1, format2 = format, format
 		}
 	}
 
-	// Determine file format
-	format1 := detectFormat(file1Path, options.OutputFormat)
-	format2 := detectFormat(file2Path, options.OutputFormat)
+	if options.Doc >= 0 && format != "yaml" {
+		return fmt.Errorf("--doc only applies to yaml documents, not %s", format)
+	}
 
-	// Use the explicitly specified format or the detected one
-	format := options.OutputFormat
-	if format == "auto" {
-		// If any of the files is .env, use env format
-		if format1 == "env" || format2 == "env" {
-			format = "env"
-		} else if format1 != format2 {
-			return fmt.Errorf("files appear to be different formats: %s and %s", format1, format2)
-		} else {
-			format = format1
+	if format == "binary" && (options.SummaryMode || options.Both || options.SummaryOut != "" || options.NumStat || options.NameOnly || options.KeysOnly) {
+		return fmt.Errorf("binary files have no keys, so they cannot be compared with --summary or the options that imply it, --both, --summary-out, --numstat, --name-only or --keys-only")
+	}
+
+	// Without a store format in the metadata, binary-encrypted files would
+	// otherwise be decrypted as YAML
+	if err := checkStoreFormat(file1Path, file1Content, format1); err != nil {
+		return err
+	}
+	if err := checkStoreFormat(file2Path, file2Content, format2); err != nil {
+		return err
+	}
+
+	// The decoded structure is only validated for formats it maps to JSON
+	if options.Schema != nil && format != "yaml" && format != "json" {
+		return fmt.Errorf("--schema only validates yaml and json documents, not %s", format)
+	}
+
+	if !options.NoKeyCheck {
+		warnKeySetMismatch(file1Path, file1Content, sopsStoreFormat(format1), file2Path, file2Content, sopsStoreFormat(format2), options)
+	}
+
+	// Byte-identical encrypted inputs decrypt to the same document, so both
+	// KMS round-trips are skipped. Identical plaintext still goes through
+	// decryption, which warns about (or rejects) decrypted files, and so does
+	// --show-unchanged, which lists every key, and --schema, which validates
+	// the documents.
+	if bytes.Equal(file1Content, file2Content) && !options.ShowUnchanged && options.Schema == nil && (isBlankDocument(file1Content) || looksEncrypted(file1Content)) {
+		if options.Verbose {
+			fmt.Fprintf(os.Stderr, "Inputs are byte-identical, skipping decryption\n")
 		}
+		return reportIdentical(file2Path, options)
 	}
 
-	// Decrypt files
-	decryptFormat := format
-	if format == "env" {
-		decryptFormat = "dotenv"
+	// Export key provider settings before any decryption happens
+	if err := applyKeyProviderEnv(options); err != nil {
+		return err
 	}
 
-	// Try to decrypt both files
+	// Try to decrypt both files concurrently, as each call may be a KMS round-trip
+	// The sops binary can ask for a PGP passphrase through pinentry on the
+	// terminal, which the spinner would draw over
+	spinnerOptions := options
+	if !options.Verbose && ((!reference1 && resolveDecryptor(file1Content, sopsStoreFormat(format1), options) == decryptorBinary) ||
+		(!reference2 && resolveDecryptor(file2Content, sopsStoreFormat(format2), options) == decryptorBinary)) {
+		spinnerOptions.Quiet = true
+	}
+	stopSpinner := startSpinner("Decrypting...", spinnerOptions)
 	var decrypted1, decrypted2 []byte
 	var decryptErr1, decryptErr2 error
-
-	decrypted1, decryptErr1 = decrypt.Data(file1Content, decryptFormat)
-	decrypted2, decryptErr2 = decrypt.Data(file2Content, decryptFormat)
+	switch {
+	case reference1 && reference2:
+		decrypted1, decrypted2 = file1Content, file2Content
+	case reference1:
+		decrypted1 = file1Content
+		decrypted2, decryptErr2 = decryptBytes(file2Content, sopsStoreFormat(format2), options)
+	case reference2:
+		decrypted1, decryptErr1 = decryptBytes(file1Content, sopsStoreFormat(format1), options)
+		decrypted2 = file2Content
+	default:
+		decrypted1, decrypted2, decryptErr1, decryptErr2 = decryptPair(file1Content, file2Content, sopsStoreFormat(format1), sopsStoreFormat(format2), options)
+	}
+	stopSpinner()
+
+	// Some plaintext documents fail in the SOPS stores instead of reporting
+	// missing metadata
+	decryptErr1 = plainDocumentError(file1Content, format1, decryptErr1)
+	decryptErr2 = plainDocumentError(file2Content, format2, decryptErr2)
+
+	// Empty and whitespace-only files hold no keys, encrypted or not, so they
+	// are compared as empty documents instead of failing or being reported as
+	// decrypted
+	if isBlankDocument(file1Content) {
+		decrypted1, decryptErr1 = nil, nil
+	}
+	if isBlankDocument(file2Content) {
+		decrypted2, decryptErr2 = nil, nil
+	}
 
 	// Handle cases where files are already decrypted (has no SOPS metadata)
 	var file1Decrypted, file2Decrypted bool
 
-	if decryptErr1 != nil && strings.Contains(decryptErr1.Error(), "sops metadata not found") {
+	if isMetadataNotFound(decryptErr1) {
 		decrypted1 = file1Content
 		decryptErr1 = nil
 		file1Decrypted = true
 
 		// Print warning for potentially unencrypted sensitive content
-		fmt.Fprintf(os.Stderr, "\033[33mWARNING: File '%s' appears to be decrypted (no SOPS metadata found)!\033[0m\n", file1Path)
-		fmt.Fprintf(os.Stderr, "\033[33m         Make sure you don't commit decrypted sensitive files.\033[0m\n")
+		warnf(options, "WARNING: File '%s' appears to be decrypted (no SOPS metadata found)!", file1Path)
+		warnf(options, "         Make sure you don't commit decrypted sensitive files.")
 
 		// If configured to error on decrypted files, return an error
 		if options.ErrorOnDecrypted {
-			return fmt.Errorf("file '%s' is decrypted, aborting as --error-on-decrypted is enabled", file1Path)
+			return &DecryptedFileError{Path: file1Path}
 		}
 	}
 
-	if decryptErr2 != nil && strings.Contains(decryptErr2.Error(), "sops metadata not found") {
+	if isMetadataNotFound(decryptErr2) {
 		// Print warning for potentially unencrypted sensitive content
-		fmt.Fprintf(os.Stderr, "\033[33mWARNING: File '%s' appears to be decrypted (no SOPS metadata found)!\033[0m\n", file2Path)
-		fmt.Fprintf(os.Stderr, "\033[33m         Make sure you don't commit decrypted sensitive files.\033[0m\n")
+		warnf(options, "WARNING: File '%s' appears to be decrypted (no SOPS metadata found)!", file2Path)
+		warnf(options, "         Make sure you don't commit decrypted sensitive files.")
 
 		// If configured to error on decrypted files, return an error
 		if options.ErrorOnDecrypted {
-			return fmt.Errorf("file '%s' is decrypted, aborting as --error-on-decrypted is enabled", file2Path)
+			return &DecryptedFileError{Path: file2Path}
 		}
 
 		decrypted2 = file2Content
@@ -336,254 +1357,893 @@ func runDiff(file1Path, file2Path string, options DiffOptions) error {
 
 	// If both files were already decrypted, show a message
 	if file1Decrypted && file2Decrypted && !options.SummaryMode {
-		fmt.Println("\033[33mBoth files appear to be already decrypted. Comparing as plain text.\033[0m")
+		message := "Both files appear to be already decrypted. Comparing as plain text."
+		if useColor(options) {
+			message = options.Colors.Modified + message + colorReset
+		}
+		fmt.Println(message)
 	} else if (file1Decrypted || file2Decrypted) && !options.SummaryMode {
 		// If one file is encrypted and one is decrypted, warn about potential false positives
-		fmt.Fprintf(os.Stderr, "\033[33mNote: Comparing encrypted and decrypted files may show structural differences\033[0m\n")
-		fmt.Fprintf(os.Stderr, "\033[33min addition to actual content changes.\033[0m\n")
+		warnf(options, "Note: Comparing encrypted and decrypted files may show structural differences")
+		warnf(options, "in addition to actual content changes.")
 	}
 
 	// If decryption fails with dotenv format, try other formats for .env files
 	if format == "env" && (decryptErr1 != nil || decryptErr2 != nil) {
 		// Try with yaml format first
 		if decryptErr1 != nil {
-			decrypted1, decryptErr1 = decrypt.Data(file1Content, "yaml")
+			decrypted1, decryptErr1 = decryptBytes(file1Content, "yaml", options)
 		}
 		if decryptErr2 != nil {
-			decrypted2, decryptErr2 = decrypt.Data(file2Content, "yaml")
+			decrypted2, decryptErr2 = decryptBytes(file2Content, "yaml", options)
 		}
 
 		// If still failing, try json format
 		if decryptErr1 != nil {
-			decrypted1, decryptErr1 = decrypt.Data(file1Content, "json")
+			decrypted1, decryptErr1 = decryptBytes(file1Content, "json", options)
 		}
 		if decryptErr2 != nil {
-			decrypted2, decryptErr2 = decrypt.Data(file2Content, "json")
+			decrypted2, decryptErr2 = decryptBytes(file2Content, "json", options)
 		}
 	}
 
 	// Return the first error encountered if decryption still failed
 	if decryptErr1 != nil {
-		return fmt.Errorf("error decrypting %s: %w", file1Path, decryptErr1)
+		return newDecryptError(file1Path, decryptErr1, options)
 	}
 
 	if decryptErr2 != nil {
-		return fmt.Errorf("error decrypting %s: %w", file2Path, decryptErr2)
+		return newDecryptError(file2Path, decryptErr2, options)
+	}
+
+	// Documents of another format are converted before they are compared
+	if format1 != format {
+		decrypted1, err = convertDocument(decrypted1, format1, format)
+		if err != nil {
+			return &ParseError{Path: file1Path, Format: format1, Err: err}
+		}
+	}
+	if format2 != format {
+		decrypted2, err = convertDocument(decrypted2, format2, format)
+		if err != nil {
+			return &ParseError{Path: file2Path, Format: format2, Err: err}
+		}
+	}
+
+	// Pick one document out of multi-document YAML files
+	if options.Doc >= 0 {
+		decrypted1, err = selectYAMLDocument(decrypted1, options.Doc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file1Path, err)
+		}
+		decrypted2, err = selectYAMLDocument(decrypted2, options.Doc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file2Path, err)
+		}
+	} else if format == "yaml" {
+		// Only the first document is decoded below
+		for _, input := range []struct {
+			path    string
+			content []byte
+		}{{file1Path, decrypted1}, {file2Path, decrypted2}} {
+			if count := countYAMLDocuments(input.content); count > 1 {
+				warnf(options, "Note: '%s' has %d YAML documents; only the first is compared, use --doc N to pick another", input.path, count)
+			}
+		}
+	}
+
+	// Binary content has no structure, it is diffed as decrypted
+	if format == "binary" {
+		return diffBinaryContent(file1Path, file2Path, decrypted1, decrypted2, options)
 	}
 
 	// For env files, we need to handle differently since they might have been encrypted using different formats
 	if format == "env" {
 		// Parse .env files directly as text
-		data1Map, err := parseEnv(decrypted1)
+		data1Env, duplicates1, err := parseEnv(decrypted1)
 		if err != nil {
-			return fmt.Errorf("error parsing ENV from %s: %w", file1Path, err)
+			return &ParseError{Path: file1Path, Format: format, Err: err}
+		}
+		if err := reportDuplicates(file1Path, duplicates1, options); err != nil {
+			return err
 		}
 
-		data2Map, err := parseEnv(decrypted2)
+		data2Env, duplicates2, err := parseEnv(decrypted2)
 		if err != nil {
-			return fmt.Errorf("error parsing ENV from %s: %w", file2Path, err)
+			return &ParseError{Path: file2Path, Format: format, Err: err}
+		}
+		if err := reportDuplicates(file2Path, duplicates2, options); err != nil {
+			return err
+		}
+
+		if options.StripSopsMeta {
+			stripSopsEnvMetadata(&data1Env)
+			stripSopsEnvMetadata(&data2Env)
 		}
+		if !options.NoSort {
+			data1Env.sortKeys()
+			data2Env.sortKeys()
+		}
+
+		env1, env2 := data1Env.document(), data2Env.document()
+		warnSuspiciousValues(Compare(env1, env2, options), options)
 
 		// If using an external diff tool
 		if options.DiffTool != "" {
-			return diffWithExternalTool(data1Map, data2Map, format, options)
+			return diffWithExternalTool(data1Env, data2Env, format, options)
+		}
+
+		noteFormattingOnly(env1, env2, decrypted1, decrypted2, options)
+
+		if options.NumStat {
+			return printOutput(formatNumStat(env1, env2, file2Path, options), options)
+		}
+		if options.NameOnly {
+			return printOutput(formatNameOnly(env1, env2, options), options)
+		}
+		if options.KeysOnly {
+			keys, err := formatKeysOnly(file1Path, file2Path, env1, env2, options)
+			if err != nil {
+				return err
+			}
+			return writeDiff(keys, options)
 		}
 
 		// Generate formatted output for comparison
 		if options.SummaryMode {
 			// Direct comparison of data for summary mode using the specialized env comparison
-			summaryOutput, err := compareEnvData(data1Map, data2Map)
+			summaryOutput, err := compareEnvData(data1Env, data2Env, options)
 			if err != nil {
 				return fmt.Errorf("error generating summary comparison: %w", err)
 			}
 
-			// If there are no changes, inform the user
-			if summaryOutput == "" {
-				fmt.Println("No changes detected in keys")
-			} else {
-				fmt.Println("Summary of key changes:")
-				fmt.Println("! = modified key, + = added key, - = removed key")
-				fmt.Println("--------------------------------------")
-				fmt.Print(summaryOutput)
-			}
-			return nil
+			return writeSummary(summaryOutput, options)
 		} else {
 			// Full mode - show keys and values
-			output1, err := formatFull(data1Map, format)
+			output1, err := formatFull(data1Env, format)
 			if err != nil {
 				return fmt.Errorf("error formatting data for %s: %w", file1Path, err)
 			}
 
-			output2, err := formatFull(data2Map, format)
+			output2, err := formatFull(data2Env, format)
 			if err != nil {
 				return fmt.Errorf("error formatting data for %s: %w", file2Path, err)
 			}
 
 			// Generate and display the diff
-			diff := generateDiff(file1Path, file2Path, output1, output2, options)
-			// Output to file or stdout
-			if options.OutputFile != "" {
-				err := ioutil.WriteFile(options.OutputFile, []byte(diff), 0644)
+			diff := truncateLines(generateDiff(file1Path, file2Path, output1, output2, options), options.MaxLines, "lines")
+			if options.Both || options.SummaryOut != "" {
+				summaryOutput, err := compareEnvData(data1Env, data2Env, options)
 				if err != nil {
-					return fmt.Errorf("error writing output to file %s: %w", options.OutputFile, err)
+					return fmt.Errorf("error generating summary comparison: %w", err)
+				}
+				if options.SummaryOut != "" {
+					if err := writeSummary(summaryOutput, options); err != nil {
+						return err
+					}
+				}
+				if options.Both {
+					diff = withSummary(formatSummaryReport(summaryOutput, options), diff)
 				}
-				fmt.Fprintf(os.Stderr, "Output written to %s\n", options.OutputFile)
-			} else {
-				// Print to stdout
-				fmt.Print(diff)
 			}
+			return writeDiff(diff, options)
 		}
+	}
+
+	// For non-env formats, continue with the normal process
+	var data1, data2 interface{}
+	blank1, blank2 := isBlankDocument(decrypted1), isBlankDocument(decrypted2)
+	checkDuplicates := options.WarnDuplicates || options.ErrorDuplicates
+	switch format {
+	case "yaml":
+		// Both decoders expand merge keys (<<: *defaults, or a list of
+		// aliases), so the flattened keys reflect the effective configuration
+		if checkDuplicates {
+			// Decode via yaml.Node so duplicate keys are reported instead of failing
+			duplicates1, err := decodeYAMLLastWins(decrypted1, &data1)
+			if err != nil {
+				return &ParseError{Path: file1Path, Format: format, Err: err}
+			}
+			if err := reportDuplicates(file1Path, duplicates1, options); err != nil {
+				return err
+			}
+
+			duplicates2, err := decodeYAMLLastWins(decrypted2, &data2)
+			if err != nil {
+				return &ParseError{Path: file2Path, Format: format, Err: err}
+			}
+			if err := reportDuplicates(file2Path, duplicates2, options); err != nil {
+				return err
+			}
+			break
+		}
+
+		err = yaml.Unmarshal(decrypted1, &data1)
+		if err != nil {
+			return &ParseError{Path: file1Path, Format: format, Err: err}
+		}
+
+		err = yaml.Unmarshal(decrypted2, &data2)
+		if err != nil {
+			return &ParseError{Path: file2Path, Format: format, Err: err}
+		}
+	case "json":
+		if checkDuplicates {
+			for _, input := range []struct {
+				path    string
+				content []byte
+			}{{file1Path, decrypted1}, {file2Path, decrypted2}} {
+				duplicates, err := findJSONDuplicates(input.content)
+				if err != nil {
+					return &ParseError{Path: input.path, Format: format, Err: err}
+				}
+				if err := reportDuplicates(input.path, duplicates, options); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !blank1 {
+			data1, err = unmarshalJSON(decrypted1)
+			if err != nil {
+				return &ParseError{Path: file1Path, Format: format, Err: err}
+			}
+		}
+
+		if !blank2 {
+			data2, err = unmarshalJSON(decrypted2)
+			if err != nil {
+				return &ParseError{Path: file2Path, Format: format, Err: err}
+			}
+		}
+	case "xml":
+		if !blank1 {
+			data1, err = parseXML(decrypted1)
+			if err != nil {
+				return &ParseError{Path: file1Path, Format: format, Err: err}
+			}
+		}
+
+		if !blank2 {
+			data2, err = parseXML(decrypted2)
+			if err != nil {
+				return &ParseError{Path: file2Path, Format: format, Err: err}
+			}
+		}
+	case "plist":
+		if !blank1 {
+			data1, err = parsePlist(decrypted1)
+			if err != nil {
+				return &ParseError{Path: file1Path, Format: format, Err: err}
+			}
+		}
+
+		if !blank2 {
+			data2, err = parsePlist(decrypted2)
+			if err != nil {
+				return &ParseError{Path: file2Path, Format: format, Err: err}
+			}
+		}
+	case "ndjson":
+		records1, err := parseNDJSON(decrypted1)
+		if err != nil {
+			return &ParseError{Path: file1Path, Format: format, Err: err}
+		}
+
+		records2, err := parseNDJSON(decrypted2)
+		if err != nil {
+			return &ParseError{Path: file2Path, Format: format, Err: err}
+		}
+
+		// Records are aligned by index, so a different count shifts the rest
+		if len(records1) != len(records2) {
+			warnf(options, "Note: '%s' has %d records and '%s' has %d", file1Path, len(records1), file2Path, len(records2))
+		}
+		data1, data2 = records1, records2
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+
+	// An empty document has no keys, so every key of the other side is
+	// reported as added or removed
+	if blank1 && format != "ndjson" {
+		data1 = map[string]interface{}{}
+	}
+	if blank2 && format != "ndjson" {
+		data2 = map[string]interface{}{}
+	}
+
+	if options.StripSopsMeta {
+		data1 = stripSopsMetadata(data1)
+		data2 = stripSopsMetadata(data2)
+	}
+
+	// Deeply nested documents are rejected up front, before any of the
+	// recursive flattening and formatting below
+	if err := checkDepth(data1, options.MaxDepth); err != nil {
+		return &ParseError{Path: file1Path, Format: format, Err: err}
+	}
+	if err := checkDepth(data2, options.MaxDepth); err != nil {
+		return &ParseError{Path: file2Path, Format: format, Err: err}
+	}
+
+	// Schema violations are reported alongside the diff, which still shows
+	if err := validateSchema(file1Path, data1, options); err != nil {
+		return err
+	}
+	if err := validateSchema(file2Path, data2, options); err != nil {
+		return err
+	}
+
+	// Show the plaintext behind base64-encoded Kubernetes Secret data
+	if options.K8sSecret && format == "yaml" {
+		data1 = decodeK8sSecretData(data1)
+		data2 = decodeK8sSecretData(data2)
+	}
+
+	if options.ExpandJSONStrings {
+		data1 = expandJSONStrings(data1)
+		data2 = expandJSONStrings(data2)
+	}
+
+	warnSuspiciousValues(Compare(data1, data2, options), options)
+
+	// If using an external diff tool
+	if options.DiffTool != "" {
+		return diffWithExternalTool(data1, data2, format, options)
+	}
+
+	noteFormattingOnly(data1, data2, decrypted1, decrypted2, options)
+
+	if options.NumStat {
+		return printOutput(formatNumStat(data1, data2, file2Path, options), options)
+	}
+	if options.NameOnly {
+		return printOutput(formatNameOnly(data1, data2, options), options)
+	}
+	if options.KeysOnly {
+		keys, err := formatKeysOnly(file1Path, file2Path, data1, data2, options)
+		if err != nil {
+			return err
+		}
+		return writeDiff(keys, options)
+	}
+
+	// Generate formatted output for comparison
+	if options.SummaryMode {
+		// Direct comparison of data for summary mode
+		summaryOutput, err := compareData(data1, data2, options)
+		if err != nil {
+			return fmt.Errorf("error generating summary comparison: %w", err)
+		}
+
+		return writeSummary(summaryOutput, options)
+	} else {
+		// Full mode - show keys and values
+		var output1, output2 string
+
+		if options.KeepComments && format == "yaml" {
+			// Render the decrypted documents themselves, comments included
+			output1, err = formatYAMLWithComments(decrypted1)
+			if err != nil {
+				return &ParseError{Path: file1Path, Format: format, Err: err}
+			}
+
+			output2, err = formatYAMLWithComments(decrypted2)
+			if err != nil {
+				return &ParseError{Path: file2Path, Format: format, Err: err}
+			}
+		} else if options.PreserveOrder && format == "json" {
+			// Render the decrypted documents themselves, in their member order
+			output1, err = formatJSONInOrder(decrypted1)
+			if err != nil {
+				return &ParseError{Path: file1Path, Format: format, Err: err}
+			}
+
+			output2, err = formatJSONInOrder(decrypted2)
+			if err != nil {
+				return &ParseError{Path: file2Path, Format: format, Err: err}
+			}
+		} else {
+			formatted1, formatted2 := data1, data2
+			if options.MultilineDiff {
+				formatted1, formatted2 = stubMultilineValues(data1), stubMultilineValues(data2)
+			}
+
+			output1, err = formatFull(formatted1, format)
+			if err != nil {
+				return fmt.Errorf("error formatting data for %s: %w", file1Path, err)
+			}
+
+			output2, err = formatFull(formatted2, format)
+			if err != nil {
+				return fmt.Errorf("error formatting data for %s: %w", file2Path, err)
+			}
+		}
+
+		// Empty documents render as no lines rather than as {}
+		if blank1 {
+			output1 = ""
+		}
+		if blank2 {
+			output2 = ""
+		}
+
+		// Generate and display the diff
+		diff := generateDiff(file1Path, file2Path, output1, output2, options)
+		if options.MultilineDiff {
+			diff += multilineValueDiffs(data1, data2, options)
+		}
+		diff = truncateLines(diff, options.MaxLines, "lines")
+		if options.Both || options.SummaryOut != "" {
+			summaryOutput, err := compareData(data1, data2, options)
+			if err != nil {
+				return fmt.Errorf("error generating summary comparison: %w", err)
+			}
+			if options.SummaryOut != "" {
+				if err := writeSummary(summaryOutput, options); err != nil {
+					return err
+				}
+			}
+			if options.Both {
+				diff = withSummary(formatSummaryReport(summaryOutput, options), diff)
+			}
+		}
+		return writeDiff(diff, options)
+	}
+}
+
+// bothDivider separates the summary from the full diff under --both
+const bothDivider = "======================================\n"
+
+// withSummary puts the summary report above the full diff for --both
+func withSummary(summaryReport, diff string) string {
+	if diff == "" {
+		return summaryReport
+	}
+	return summaryReport + bothDivider + diff
+}
+
+// writeDiff writes the full diff to the --output file, or to stdout
+func writeDiff(diff string, options DiffOptions) error {
+	if options.OutputFile != "" {
+		return writeOutputFile(options.OutputFile, diff)
+	}
+	return printOutput(diff, options)
+}
+
+// writeSummary writes the summary report to the --summary-out file, without
+// colors, or to stdout
+func writeSummary(summaryOutput string, options DiffOptions) error {
+	if options.SummaryOut != "" {
+		plain := options
+		plain.ColorOutput = false
+		return writeOutputFile(options.SummaryOut, formatSummaryReport(summaryOutput, plain))
+	}
+	return printOutput(formatSummaryReport(summaryOutput, options), options)
+}
+
+// writeOutputFile writes an output file readable only by the user, as it
+// holds key names and, for the full diff, secret values. Missing parent
+// directories are created.
+func writeOutputFile(path, content string) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("error creating directory for output file %s: %w", path, err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing output to file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	// An existing file keeps its mode, so restrict it before any plaintext
+	// is written
+	if err := f.Chmod(0600); err != nil {
+		return fmt.Errorf("error writing output to file %s: %w", path, err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		return fmt.Errorf("error writing output to file %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing output to file %s: %w", path, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Output written to %s\n", path)
+	return nil
+}
+
+// reportIdentical prints what the selected output mode shows for two inputs
+// without any changes, without decrypting them
+func reportIdentical(path string, options DiffOptions) error {
+	empty := map[string]interface{}{}
+	switch {
+	case options.DiffTool != "":
 		return nil
+	case options.NumStat:
+		return printOutput(formatNumStat(empty, empty, path, options), options)
+	case options.NameOnly:
+		return nil
+	case options.SummaryMode:
+		return writeSummary("", options)
 	}
 
-	// For non-env formats, continue with the normal process
-	var data1, data2 interface{}
-	switch format {
-	case "yaml":
-		err = yaml.Unmarshal(decrypted1, &data1)
-		if err != nil {
-			return fmt.Errorf("error parsing YAML from %s: %w", file1Path, err)
+	if options.SummaryOut != "" {
+		if err := writeSummary("", options); err != nil {
+			return err
 		}
+	}
 
-		err = yaml.Unmarshal(decrypted2, &data2)
-		if err != nil {
-			return fmt.Errorf("error parsing YAML from %s: %w", file2Path, err)
-		}
-	case "json":
-		err = json.Unmarshal(decrypted1, &data1)
-		if err != nil {
-			return fmt.Errorf("error parsing JSON from %s: %w", file1Path, err)
-		}
+	// The full diff of identical documents is empty
+	if options.Both {
+		return writeDiff(formatSummaryReport("", options), options)
+	}
+	if options.OutputFile != "" {
+		return writeOutputFile(options.OutputFile, "")
+	}
+	return nil
+}
 
-		err = json.Unmarshal(decrypted2, &data2)
-		if err != nil {
-			return fmt.Errorf("error parsing JSON from %s: %w", file2Path, err)
-		}
-	default:
-		return fmt.Errorf("unsupported format: %s", format)
+// noteFormattingOnly tells the reader when two decrypted documents differ as
+// text but hold the same keys and values, so only comments or formatting
+// changed. The note goes to stderr to keep diffs and patches clean.
+func noteFormattingOnly(data1, data2 interface{}, decrypted1, decrypted2 []byte, options DiffOptions) {
+	if bytes.Equal(decrypted1, decrypted2) {
+		return
 	}
 
-	// If using an external diff tool
-	if options.DiffTool != "" {
-		return diffWithExternalTool(data1, data2, format, options)
+	// Keys differing only in case or values only in whitespace are real
+	// changes here, even when the normalizing flags hide them in the diff
+	strict := options
+	strict.IgnoreKeyCase = false
+	strict.IgnoreValueWhitespace = false
+	strict.CollapseValueWhitespace = false
+	if !Compare(data1, data2, strict).HasChanges() {
+		warnf(options, "Note: values identical; only comments/formatting differ")
 	}
+}
 
-	// Generate formatted output for comparison
-	if options.SummaryMode {
-		// Direct comparison of data for summary mode
-		summaryOutput, err := compareData(data1, data2)
-		if err != nil {
-			return fmt.Errorf("error generating summary comparison: %w", err)
-		}
+// truncateLines keeps the first maxLines lines of output and replaces the
+// rest with a footer counting what was left out. Zero means no limit.
+func truncateLines(output string, maxLines int, unit string) string {
+	if maxLines <= 0 {
+		return output
+	}
 
-		// If there are no changes, inform the user
-		if summaryOutput == "" {
-			fmt.Println("No changes detected in keys")
+	lines := strings.SplitAfter(output, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= maxLines {
+		return output
+	}
+
+	return strings.Join(lines[:maxLines], "") + fmt.Sprintf("... (truncated, %d more %s)\n", len(lines)-maxLines, unit)
+}
+
+// formatNumStat counts the added, removed and modified keys between two
+// documents as a tab-separated line for scripts, like git diff --numstat
+func formatNumStat(data1, data2 interface{}, path string, options DiffOptions) string {
+	result := filterChanges(Compare(data1, data2, options), options)
+	return fmt.Sprintf("%d\t%d\t%d\t%s\n", len(result.Added), len(result.Removed), len(result.Modified), path)
+}
+
+// formatNameOnly lists the distinct top-level keys that contain a change, one
+// per line, or only NameOnlyPath when it is set and anything changed
+func formatNameOnly(data1, data2 interface{}, options DiffOptions) string {
+	names := make(map[string]bool)
+	for _, change := range filterChanges(Compare(data1, data2, options), options).changes() {
+		if change.Kind == changeUnchanged {
+			continue
+		}
+		top := splitKeyPath(change.Key, options.PathStyle)[0]
+		if top == rootKeyPath || strings.HasPrefix(top, "[") {
+			names[top] = true
 		} else {
-			fmt.Println("Summary of key changes:")
-			fmt.Println("! = modified key, + = added key, - = removed key")
-			fmt.Println("--------------------------------------")
-			fmt.Print(summaryOutput)
+			names[sopsdiff.JoinKeyPath("", top, options.PathStyle)] = true
 		}
-		return nil
-	} else {
-		// Full mode - show keys and values
-		var output1, output2 string
+	}
 
-		output1, err = formatFull(data1, format)
-		if err != nil {
-			return fmt.Errorf("error formatting data for %s: %w", file1Path, err)
-		}
+	if len(names) == 0 {
+		return ""
+	}
+	if options.NameOnlyPath != "" {
+		return options.NameOnlyPath + "\n"
+	}
 
-		output2, err = formatFull(data2, format)
-		if err != nil {
-			return fmt.Errorf("error formatting data for %s: %w", file2Path, err)
+	var buffer strings.Builder
+	for _, name := range sortedKeySet(names) {
+		buffer.WriteString(name + "\n")
+	}
+	return buffer.String()
+}
+
+// formatSummaryReport wraps the summary of key changes with its header and
+// legend, truncated to --max-lines keys
+func formatSummaryReport(summaryOutput string, options DiffOptions) string {
+	// If there are no changes, inform the user
+	if summaryOutput == "" {
+		if options.NoLegend {
+			return ""
 		}
+		return "No changes detected in keys\n"
+	}
 
-		// Generate and display the diff
-		diff := generateDiff(file1Path, file2Path, output1, output2, options)
+	legend := options.Markers.legend(options.ShowUnchanged)
+	summaryOutput = truncateLines(summaryOutput, options.MaxLines, "keys")
 
-		// Output to file or stdout
-		if options.OutputFile != "" {
-			err := ioutil.WriteFile(options.OutputFile, []byte(diff), 0644)
-			if err != nil {
-				return fmt.Errorf("error writing output to file %s: %w", options.OutputFile, err)
-			}
-			fmt.Fprintf(os.Stderr, "Output written to %s\n", options.OutputFile)
-		} else {
-			// Print to stdout
-			fmt.Print(diff)
-		}
+	// Markers are colored like diff lines; removed keys may be exposed
+	// secrets, so they stand out in bold with the default palettes
+	if useColor(options) {
+		legend = colorSummary(legend, options, ", ")
+		summaryOutput = colorSummary(summaryOutput, options, "\n")
 	}
 
-	return nil
+	// Only the change lines, for scripts reading the summary
+	if options.NoLegend {
+		return summaryOutput
+	}
+
+	var report strings.Builder
+	report.WriteString("Summary of key changes:\n")
+	report.WriteString(legend + "\n")
+	report.WriteString("--------------------------------------\n")
+	report.WriteString(summaryOutput)
+	return report.String()
+}
+
+// colorSummary colors the entries of a flat or tree summary, or of its
+// legend, by their change marker. Entries are separated by sep, and tree
+// entries without a marker are left as they are.
+func colorSummary(summaryOutput string, options DiffOptions, sep string) string {
+	markerColors := map[string]string{
+		options.Markers.marker(changeAdded):    options.Colors.Added,
+		options.Markers.marker(changeRemoved):  options.Colors.Removed,
+		options.Markers.marker(changeModified): options.Colors.Modified,
+	}
+
+	entries := strings.Split(summaryOutput, sep)
+	for i, entry := range entries {
+		trimmed := strings.TrimLeft(entry, " ")
+		end := strings.IndexAny(trimmed, " \t")
+		if color, ok := markerColors[trimmed[:max(end, 0)]]; ok && end >= 0 {
+			indent := entry[:len(entry)-len(trimmed)]
+			entries[i] = indent + color + trimmed + colorReset
+		}
+	}
+	return strings.Join(entries, sep)
 }
 
 // detectFormat detects the file format based on extension or specified format
-func detectFormat(filePath, specifiedFormat string) string {
-	if specifiedFormat != "auto" {
-		return specifiedFormat
+func detectFormat(filePath string, options DiffOptions) string {
+	if options.OutputFormat != "auto" {
+		return options.OutputFormat
+	}
+
+	if format, ok := extensionFormat(filePath, options); ok {
+		return format
+	}
+
+	// Default to YAML if can't detect
+	return "yaml"
+}
+
+// detectInputFormat detects the format of an input like detectFormat, but
+// falls back to sniffing its content when the extension is not recognized
+func detectInputFormat(filePath string, content []byte, options DiffOptions) string {
+	if options.OutputFormat != "auto" {
+		return options.OutputFormat
+	}
+
+	if format, ok := extensionFormat(filePath, options); ok {
+		return format
+	}
+
+	format := sniffFormat(content)
+	if options.Verbose {
+		fmt.Fprintf(os.Stderr, "Detected %s format for %s from its content\n", format, filePath)
+	}
+	return format
+}
+
+// extensionFormat returns the format for a file's extension, and false when
+// the extension is not recognized
+func extensionFormat(filePath string, options DiffOptions) (string, bool) {
+	// Detect URLs and S3 objects by the extension of their path, ignoring any
+	// query string or version
+	if isURL(filePath) {
+		filePath = urlPath(filePath)
+	} else if isS3URI(filePath) {
+		filePath = s3Key(filePath)
 	}
 
+	// Compressed files are detected by their inner extension (secrets.yaml.gz)
+	filePath = strings.TrimSuffix(filePath, ".gz")
+
 	ext := strings.ToLower(filepath.Ext(filePath))
+	if format, ok := options.ExtensionFormats[ext]; ok {
+		return format, true
+	}
+
 	switch ext {
 	case ".json":
-		return "json"
+		return "json", true
 	case ".yaml", ".yml":
-		return "yaml"
+		return "yaml", true
 	case ".env":
-		return "env"
+		return "env", true
+	case ".xml":
+		return "xml", true
+	case ".ndjson", ".jsonl":
+		return "ndjson", true
+	case ".plist":
+		return "plist", true
 	default:
-		// Default to YAML if can't detect
+		return "", false
+	}
+}
+
+// envLine matches an assignment line of an environment file
+var envLine = regexp.MustCompile(`^(export\s+)?[A-Za-z_][A-Za-z0-9_.]*=`)
+
+// sniffFormat guesses the format of a document from its content: files
+// written by the SOPS binary store by their shape, JSON and XML by their
+// leading character, ENV when every line is an assignment or a comment, and
+// YAML otherwise. Encrypted files keep the structure of their format, so this
+// works before decryption as well.
+func sniffFormat(content []byte) string {
+	trimmed := bytes.TrimSpace(content)
+	switch {
+	case len(trimmed) == 0:
 		return "yaml"
+	case isBinaryStoreFile(trimmed):
+		return "binary"
+	case (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed):
+		return "json"
+	case trimmed[0] == '{' && isNDJSON(trimmed):
+		return "ndjson"
+	case isBinaryPlist(trimmed) || isXMLPlist(trimmed):
+		return "plist"
+	case trimmed[0] == '<':
+		return "xml"
+	}
+
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") && !envLine.MatchString(line) {
+			return "yaml"
+		}
+	}
+	return "env"
+}
+
+// sopsStoreFormat returns the SOPS store used to decrypt a format. SOPS has
+// no XML, NDJSON or plist store, so those files are encrypted as binary.
+func sopsStoreFormat(format string) string {
+	switch format {
+	case "env":
+		return "dotenv"
+	case "xml", "ndjson", "plist", "binary":
+		return "binary"
+	default:
+		return format
+	}
+}
+
+// parseExtensionMap validates the --ext-map entries, returning them keyed by
+// lowercase extension with a leading dot
+func parseExtensionMap(entries map[string]string) (map[string]string, error) {
+	formats := make(map[string]string, len(entries))
+	for ext, format := range entries {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			return nil, fmt.Errorf("invalid --ext-map entry %q: missing extension", "="+format)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		format = strings.ToLower(strings.TrimSpace(format))
+		switch format {
+		case "yaml", "json", "env", "xml", "ndjson", "plist", "binary":
+			formats[ext] = format
+		default:
+			return nil, fmt.Errorf("invalid --ext-map format %q for %s: must be yaml, json, env, xml, ndjson, plist or binary", format, ext)
+		}
 	}
+	return formats, nil
 }
 
-// parseEnv parses an environment file into a map
-func parseEnv(data []byte) (map[string]string, error) {
-	result := make(map[string]string)
+// envFile holds the variables of an environment file. Keys lists every
+// variable once, in the order it is first defined in the file.
+type envFile struct {
+	Keys   []string
+	Values map[string]string
+}
+
+// sortKeys orders the variables alphabetically, as the full diff shows
+// them unless --no-sort is set
+func (e *envFile) sortKeys() {
+	sort.Strings(e.Keys)
+}
+
+// document returns the variables as a decoded document, for the code shared
+// with the other formats
+func (e envFile) document() map[string]interface{} {
+	result := make(map[string]interface{}, len(e.Keys))
+	for _, k := range e.Keys {
+		result[k] = e.Values[k]
+	}
+	return result
+}
+
+// parseEnv parses an environment file, reporting keys that are defined more
+// than once. A redefined key keeps its first position and its last value.
+func parseEnv(data []byte) (envFile, []duplicateKey, error) {
+	result := envFile{Values: make(map[string]string)}
+	var duplicates []duplicateKey
 	lines := strings.Split(string(data), "\n")
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Skip empty lines, comments, and lines obviously not in .env format
-		if line == "" ||
-			strings.HasPrefix(line, "#") ||
-			strings.HasPrefix(line, "{") ||
-			strings.HasPrefix(line, "[") ||
-			strings.HasPrefix(line, "---") ||
-			strings.HasPrefix(line, "sops:") ||
-			strings.Contains(line, ": |") {
+	for i, line := range lines {
+		key, value, ok := parseEnvLine(line)
+		if !ok {
 			continue
 		}
 
-		// Find the first equals sign
-		idx := strings.Index(line, "=")
-		if idx <= 0 {
-			// Skip lines without = or if = is the first character
-			continue
+		if _, exists := result.Values[key]; exists {
+			duplicates = append(duplicates, duplicateKey{Key: key, Line: i + 1})
+		} else {
+			result.Keys = append(result.Keys, key)
 		}
+		result.Values[key] = value
+	}
 
-		key := strings.TrimSpace(line[:idx])
-		value := strings.TrimSpace(line[idx+1:])
+	return result, duplicates, nil
+}
 
-		// Handle quoted values
-		if len(value) > 1 && (value[0] == '"' && value[len(value)-1] == '"' ||
-			value[0] == '\'' && value[len(value)-1] == '\'') {
-			value = value[1 : len(value)-1]
-		}
+// parseEnvLine parses one line of an environment file, reporting whether it
+// defines a variable
+func parseEnvLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	// Skip empty lines, comments, and lines obviously not in .env format
+	if line == "" ||
+		strings.HasPrefix(line, "#") ||
+		strings.HasPrefix(line, "{") ||
+		strings.HasPrefix(line, "[") ||
+		strings.HasPrefix(line, "---") ||
+		strings.HasPrefix(line, "sops:") ||
+		strings.Contains(line, ": |") {
+		return "", "", false
+	}
+
+	// Find the first equals sign
+	idx := strings.Index(line, "=")
+	if idx <= 0 {
+		// Skip lines without = or if = is the first character
+		return "", "", false
+	}
+
+	// KEY= is kept with an empty value, which is not the same as unset
+	key := strings.TrimSpace(line[:idx])
+	value := strings.TrimSpace(line[idx+1:])
 
-		result[key] = value
+	// Handle quoted values
+	if len(value) > 1 && (value[0] == '"' && value[len(value)-1] == '"' ||
+		value[0] == '\'' && value[len(value)-1] == '\'') {
+		value = value[1 : len(value)-1]
 	}
 
-	return result, nil
+	return key, value, true
 }
 
-// formatSummary formats data showing only the keys (for summary mode)
-func formatSummary(data interface{}, format string) (string, error) {
+// formatSummary formats data showing only the keys, one per line in the
+// given path style, each with the type of its value (for --keys-only)
+func formatSummary(data interface{}, style string) (string, error) {
 	// Flatten the data structure to get all keys
 	flatMap := make(map[string]interface{})
-	flatten(data, "", flatMap)
+	sopsdiff.FlattenDocument(data, flatMap, style)
 
 	var keys []string
 	for k := range flatMap {
@@ -595,13 +2255,59 @@ func formatSummary(data interface{}, format string) (string, error) {
 
 	var buffer strings.Builder
 	for _, k := range keys {
-		buffer.WriteString(k)
+		buffer.WriteString(summaryKey(k))
+		buffer.WriteString(" (" + valueTypeName(flatMap[k]) + ")")
 		buffer.WriteString("\n")
 	}
 
 	return buffer.String(), nil
 }
 
+// valueTypeName names the type of a flattened value in JSON schema terms,
+// so the same value reads the same in YAML, JSON and env files
+func valueTypeName(v interface{}) string {
+	switch value := v.(type) {
+	case nullValue, nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64, uint64, json.Number:
+		return "integer"
+	case float64:
+		if value == math.Trunc(value) && !math.IsInf(value, 0) {
+			return "integer"
+		}
+		return "number"
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case plistDate:
+		return "date"
+	case plistData:
+		return "data"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// formatKeysOnly diffs the key lists of two documents for --keys-only, so
+// added and removed keys and keys whose type changed show up without values
+func formatKeysOnly(file1, file2 string, data1, data2 interface{}, options DiffOptions) (string, error) {
+	keys1, err := formatSummary(data1, options.PathStyle)
+	if err != nil {
+		return "", fmt.Errorf("error listing keys of %s: %w", file1, err)
+	}
+
+	keys2, err := formatSummary(data2, options.PathStyle)
+	if err != nil {
+		return "", fmt.Errorf("error listing keys of %s: %w", file2, err)
+	}
+
+	return truncateLines(generateDiff(file1, file2, keys1, keys2, options), options.MaxLines, "lines"), nil
+}
+
 // formatFull formats data showing keys and values (for full mode)
 func formatFull(data interface{}, format string) (string, error) {
 	var output []byte
@@ -612,25 +2318,31 @@ func formatFull(data interface{}, format string) (string, error) {
 		output, err = yaml.Marshal(data)
 	case "json":
 		output, err = json.MarshalIndent(data, "", "  ")
+	case "xml":
+		return formatXML(data)
+	case "ndjson":
+		return formatNDJSON(data)
+	case "plist":
+		return formatPlist(data)
+	case "binary":
+		// Binary content is diffed as it is
+		if content, ok := data.(string); ok {
+			return content, nil
+		}
+		return "", fmt.Errorf("expected decrypted content for binary format, got %T", data)
 	case "env":
 		// For ENV format, convert to a string representation
-		if m, ok := data.(map[string]string); ok {
-			var keys []string
-			for k := range m {
-				keys = append(keys, k)
-			}
-			sort.Strings(keys)
-
+		if env, ok := data.(envFile); ok {
 			var buffer strings.Builder
-			for _, k := range keys {
+			for _, k := range env.Keys {
 				buffer.WriteString(k)
 				buffer.WriteString("=")
-				buffer.WriteString(m[k])
+				buffer.WriteString(env.Values[k])
 				buffer.WriteString("\n")
 			}
 			return buffer.String(), nil
 		} else {
-			return "", fmt.Errorf("expected map[string]string for ENV format, got %T", data)
+			return "", fmt.Errorf("expected an env file for ENV format, got %T", data)
 		}
 	default:
 		return "", fmt.Errorf("unsupported output format: %s", format)
@@ -643,45 +2355,153 @@ func formatFull(data interface{}, format string) (string, error) {
 	return string(output), nil
 }
 
+// formatJSONInOrder re-indents a JSON document like formatFull, keeping its
+// members in the order they appear in the file
+func formatJSONInOrder(content []byte) (string, error) {
+	if isBlankDocument(content) {
+		return "", nil
+	}
+
+	var compact, indented bytes.Buffer
+	if err := json.Compact(&compact, content); err != nil {
+		return "", err
+	}
+	if err := json.Indent(&indented, compact.Bytes(), "", "  "); err != nil {
+		return "", err
+	}
+	return indented.String(), nil
+}
+
+// formatYAMLWithComments re-renders a YAML document through yaml.Node, which
+// keeps comments and key order, with the same indentation as formatFull
+func formatYAMLWithComments(content []byte) (string, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(content, &node); err != nil {
+		return "", err
+	}
+	if node.Kind == 0 {
+		return "", nil
+	}
+
+	output, err := yaml.Marshal(&node)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
 // generateDiff creates a diff output between two strings
 func generateDiff(file1, file2, text1, text2 string, options DiffOptions) string {
-	fromFile := "a/" + filepath.Base(file1)
-	toFile := "b/" + filepath.Base(file2)
+	fromFile := "a/" + inputBase(file1)
+	toFile := "b/" + inputBase(file2)
+
+	// Patches keep the full relative path so git apply can locate the file
+	if options.Patch {
+		fromFile = "a/" + patchPath(file1)
+		toFile = "b/" + patchPath(file2)
+	}
+
+	// An empty document has no lines, where SplitLines would return one
+	lines := func(text string) []string {
+		if text == "" {
+			return nil
+		}
+		return difflib.SplitLines(text)
+	}
 
 	diff := difflib.UnifiedDiff{
-		A:        difflib.SplitLines(text1),
-		B:        difflib.SplitLines(text2),
+		A:        lines(text1),
+		B:        lines(text2),
 		FromFile: fromFile,
 		ToFile:   toFile,
 		Context:  3,
 		Eol:      "\n",
 	}
 
-	result, _ := difflib.GetUnifiedDiffString(diff)
+	result := addHunkContext(unifiedDiff(diff, options.DiffAlgorithm, options.IgnoreWhitespace), text1, text2, options.PathStyle)
+
+	// A patch is plain text with a git-style header, ready for git apply
+	if options.Patch {
+		if result == "" {
+			return ""
+		}
+		return fmt.Sprintf("diff --git %s %s\n", fromFile, toFile) + result
+	}
 
 	// Apply colors if enabled and output is to a terminal
-	if options.ColorOutput && isatty.IsTerminal(os.Stdout.Fd()) {
-		result = colorDiff(result)
+	if useColor(options) {
+		result = colorDiff(result, options.Colors, options.ColorMoved)
 	}
 
 	return result
 }
 
+// patchPath returns a file path in the slash-separated, relative form used in
+// patch headers
+func patchPath(path string) string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	return strings.TrimPrefix(path, "/")
+}
+
+// movedLines finds the removed and added lines of a diff whose content, with
+// its indentation, appears on the other side too, so the line was moved
+// rather than changed. A trailing comma is ignored, since moving a JSON member
+// adds or drops it. Each removed line pairs with at most one added line.
+// Lines without any letter or digit, such as closing braces, never count as
+// moved.
+func movedLines(lines []string) map[int]bool {
+	removed := make(map[string][]int)
+	added := make(map[string][]int)
+	for i, line := range lines {
+		if len(line) == 0 || strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") {
+			continue
+		}
+		content := strings.TrimSuffix(line[1:], ",")
+		if strings.IndexFunc(content, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		switch line[0] {
+		case '-':
+			removed[content] = append(removed[content], i)
+		case '+':
+			added[content] = append(added[content], i)
+		}
+	}
+
+	moved := make(map[int]bool)
+	for content, from := range removed {
+		to := added[content]
+		for j := 0; j < len(from) && j < len(to); j++ {
+			moved[from[j]] = true
+			moved[to[j]] = true
+		}
+	}
+	return moved
+}
+
 // colorDiff applies ANSI color codes to make diff output more readable
-func colorDiff(diff string) string {
+func colorDiff(diff string, colors colorScheme, colorMoved bool) string {
 	lines := strings.Split(diff, "\n")
 	var colored []string
 
-	for _, line := range lines {
-		if strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++") {
-			// Green for additions
-			colored = append(colored, "\033[32m"+line+"\033[0m")
+	var moved map[int]bool
+	if colorMoved {
+		moved = movedLines(lines)
+	}
+
+	for i, line := range lines {
+		if moved[i] {
+			// Dimmed, since the content itself did not change
+			colored = append(colored, colors.Moved+line+colorReset)
+		} else if strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++") {
+			// Green by default for additions
+			colored = append(colored, colors.Added+line+colorReset)
 		} else if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "---") {
-			// Red for deletions
-			colored = append(colored, "\033[31m"+line+"\033[0m")
+			// Bold red by default for deletions, which may be removed secrets
+			colored = append(colored, colors.Removed+line+colorReset)
 		} else if strings.HasPrefix(line, "@@") {
-			// Cyan for line information
-			colored = append(colored, "\033[36m"+line+"\033[0m")
+			// Cyan by default for line information
+			colored = append(colored, colors.Header+line+colorReset)
 		} else {
 			colored = append(colored, line)
 		}
@@ -714,12 +2534,12 @@ func diffWithExternalTool(data1, data2 interface{}, format string, options DiffO
 		var err error
 
 		// Use appropriate comparison function based on data type
-		if _, ok := data1.(map[string]string); ok && format == "env" {
+		if env1, ok := data1.(envFile); ok && format == "env" {
 			// For env files
-			summaryOutput, err = compareEnvData(data1.(map[string]string), data2.(map[string]string))
+			summaryOutput, err = compareEnvData(env1, data2.(envFile), options)
 		} else {
 			// For other formats
-			summaryOutput, err = compareData(data1, data2)
+			summaryOutput, err = compareData(data1, data2, options)
 		}
 		if err != nil {
 			return fmt.Errorf("error generating summary comparison: %w", err)
@@ -728,7 +2548,7 @@ func diffWithExternalTool(data1, data2 interface{}, format string, options DiffO
 		if summaryOutput == "" {
 			summaryOutput = "No changes detected in keys\n"
 		} else {
-			summaryOutput = "Summary of key changes:\n! = modified key, + = added key, - = removed key\n--------------------------------------\n" + summaryOutput
+			summaryOutput = "Summary of key changes:\n" + options.Markers.legend(options.ShowUnchanged) + "\n--------------------------------------\n" + summaryOutput
 		}
 
 		if _, err := tmpFile1.WriteString(summaryOutput); err != nil {
@@ -780,60 +2600,229 @@ func diffWithExternalTool(data1, data2 interface{}, format string, options DiffO
 	}
 }
 
+// expandGlobs replaces arguments containing glob metacharacters with the
+// files they match. Literal paths, URLs and Git references are kept as is.
+func expandGlobs(args []string) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") || isURL(arg) || isS3URI(arg) || isGitRef(arg) {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		// An existing file whose name contains a metacharacter is not a pattern
+		if _, err := os.Stat(arg); err == nil {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern %q did not match any files", arg)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// isGitRef reports whether an input looks like a REVISION:PATH reference
+func isGitRef(input string) bool {
+	return strings.Contains(input, ":") && !isURL(input) && !isS3URI(input) && !isZipEntry(input) && !isWindowsDrivePath(input)
+}
+
+// isWindowsDrivePath reports whether an input is an absolute Windows path
+// such as C:\secrets\a.enc.yaml, whose colon does not separate a revision.
+// On Windows, drive-relative paths such as C:secrets\*.yaml count too.
+func isWindowsDrivePath(input string) bool {
+	if len(input) < 2 || input[1] != ':' {
+		return false
+	}
+	if runtime.GOOS != "windows" && (len(input) < 3 || (input[2] != '\\' && input[2] != '/')) {
+		return false
+	}
+	drive := input[0]
+	return ('a' <= drive && drive <= 'z') || ('A' <= drive && drive <= 'Z')
+}
+
+// readInput reads an input file from a URL, S3, a zip archive, a Git revision
+// or the filesystem, decompressing it unless --no-decompress is set
+func readInput(path string, fromGit bool, options DiffOptions) ([]byte, error) {
+	var content []byte
+	var err error
+
+	switch {
+	case isURL(path):
+		content, err = fetchURL(path, options.Timeout, options.MaxFileSize)
+	case isS3URI(path):
+		content, err = fetchS3Object(path, options)
+	case isZipEntry(path):
+		content, err = readZipEntry(path, options.MaxFileSize)
+	case fromGit:
+		content, err = readGitFile(path)
+		if err == nil && options.MaxFileSize > 0 && int64(len(content)) > options.MaxFileSize {
+			err = fileTooLargeError(options.MaxFileSize)
+		}
+	default:
+		if err := checkFileSize(path, options.MaxFileSize); err != nil {
+			return nil, err
+		}
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil || options.NoDecompress {
+		return content, err
+	}
+
+	return decompressInput(content, options.MaxFileSize)
+}
+
+// gitRelativePath makes a path argument relative to the working directory
+// rather than the repository root when used in a REVISION:PATH reference
+func gitRelativePath(path string) string {
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") {
+		return path
+	}
+	return "./" + path
+}
+
+// gitStagedRef returns the index (staged) reference for a working tree file
+func gitStagedRef(path string) (string, error) {
+	ref := ":" + gitRelativePath(path)
+	if err := exec.Command("git", "cat-file", "-e", ref).Run(); err != nil {
+		return "", fmt.Errorf("path %s is not in the Git index", path)
+	}
+	return ref, nil
+}
+
+// gitRevisionRefs turns --git-rev OLD --git-rev NEW PATH, or --git OLD NEW PATH,
+// into REVISION:PATH references and checks the path exists at both revisions
+func gitRevisionRefs(revs []string, args []string) (string, string, error) {
+	var oldRev, newRev, path string
+	switch {
+	case len(revs) == 0:
+		oldRev, newRev, path = args[0], args[1], args[2]
+	case len(revs) == 2 && len(args) == 1:
+		oldRev, newRev, path = revs[0], revs[1], args[0]
+	default:
+		return "", "", fmt.Errorf("--git-rev must be given exactly twice, followed by a single path")
+	}
+
+	path = gitRelativePath(path)
+	for _, rev := range []string{oldRev, newRev} {
+		cmd := exec.Command("git", "cat-file", "-e", rev+":"+path)
+		if err := cmd.Run(); err != nil {
+			return "", "", fmt.Errorf("path %s does not exist at revision %s", path, rev)
+		}
+	}
+
+	return oldRev + ":" + path, newRev + ":" + path, nil
+}
+
 // readGitFile reads content from a Git revision (e.g., HEAD:path/to/file)
 func readGitFile(gitPath string) ([]byte, error) {
 	parts := strings.SplitN(gitPath, ":", 2)
-	if len(parts) != 2 {
+	if len(parts) != 2 || !isGitRef(gitPath) {
 		// Not a Git path, treat as a regular file
 		return ioutil.ReadFile(gitPath)
 	}
 
+	// An empty revision (:path) makes git show read the version staged in the index
 	revision := parts[0]
 	path := parts[1]
 
-	// Use git show to get the content
+	// Use git show to get the content. Its stderr is kept for the error
+	// rather than printed, since the error already explains the failure.
 	cmd := exec.Command("git", "show", revision+":"+path)
-	var output bytes.Buffer
+	var output, stderr bytes.Buffer
 	cmd.Stdout = &output
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("git show command failed: %w", err)
+		return nil, gitShowError(revision, path, strings.TrimSpace(stderr.String()), err)
 	}
 
 	return output.Bytes(), nil
 }
 
-// flatten recursively flattens a nested data structure into a map with dot notation keys
-func flatten(data interface{}, prefix string, result map[string]interface{}) {
+// gitShowError explains a failed git show, recognizing the common cases of a
+// path missing from the revision, an unknown revision and not being inside a
+// repository. Git's own message is always included.
+func gitShowError(revision, path, stderr string, err error) error {
+	message := strings.TrimPrefix(stderr, "fatal: ")
+	if message == "" {
+		message = err.Error()
+	}
+
+	switch {
+	case strings.Contains(stderr, "not a git repository"):
+		return fmt.Errorf("not inside a Git repository, so %s cannot be read from revision %q (git: %s): %w", path, revision, message, err)
+	case revision == "" && strings.Contains(stderr, "does not exist"):
+		return fmt.Errorf("%s is not staged in the Git index (git: %s): %w", path, message, err)
+	case strings.Contains(stderr, "does not exist in") || strings.Contains(stderr, "exists on disk, but not in"):
+		return fmt.Errorf("%s does not exist in revision %q (git: %s): %w", path, revision, message, err)
+	case strings.Contains(stderr, "invalid object name") || strings.Contains(stderr, "unknown revision"):
+		return fmt.Errorf("unknown Git revision %q (git: %s): %w", revision, message, err)
+	default:
+		return fmt.Errorf("git show %s:%s failed: %s: %w", revision, path, message, err)
+	}
+}
+
+// Supported notations for flattened key paths
+const (
+	pathStyleDot     = sopsdiff.PathStyleDot
+	pathStylePointer = sopsdiff.PathStylePointer
+)
+
+// rootKeyPath names the single entry of a document that is a bare scalar
+const rootKeyPath = sopsdiff.RootKeyPath
+
+// defaultMaxDepth is the default --max-depth, far beyond any real
+// configuration file but well within the stack
+const defaultMaxDepth = 1000
+
+// checkDepth returns an error when maps and lists in a decoded document nest
+// deeper than maxDepth levels, the top-level mapping being the first. Zero
+// means no limit.
+func checkDepth(data interface{}, maxDepth int) error {
+	if maxDepth > 0 && exceedsDepth(data, 1, maxDepth) {
+		return fmt.Errorf("document nests deeper than --max-depth %d levels", maxDepth)
+	}
+	return nil
+}
+
+// exceedsDepth reports whether data, found at the given depth, nests deeper
+// than maxDepth. It stops descending at the limit, so it cannot overflow the
+// stack itself.
+func exceedsDepth(data interface{}, depth, maxDepth int) bool {
+	var children []interface{}
 	switch v := data.(type) {
 	case map[string]interface{}:
-		for k, val := range v {
-			newKey := k
-			if prefix != "" {
-				newKey = prefix + "." + k
-			}
-			flatten(val, newKey, result)
+		for _, val := range v {
+			children = append(children, val)
 		}
 	case map[interface{}]interface{}:
-		for k, val := range v {
-			strKey, ok := k.(string)
-			if !ok {
-				strKey = fmt.Sprintf("%v", k)
-			}
-
-			newKey := strKey
-			if prefix != "" {
-				newKey = prefix + "." + strKey
-			}
-			flatten(val, newKey, result)
+		for _, val := range v {
+			children = append(children, val)
 		}
 	case []interface{}:
-		for i, val := range v {
-			newKey := fmt.Sprintf("%s[%d]", prefix, i)
-			flatten(val, newKey, result)
+		children = v
+	case *xmlNode:
+		for _, val := range v.Children {
+			children = append(children, val)
 		}
 	default:
-		result[prefix] = v
+		return false
+	}
+
+	if depth > maxDepth {
+		return true
+	}
+	for _, child := range children {
+		if exceedsDepth(child, depth+1, maxDepth) {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// testOptions returns the options of a plain sops-diff run
+func testOptions() DiffOptions {
+	return DiffOptions{
+		OutputFormat: "auto",
+		PathStyle:    pathStyleDot,
+		MaxDepth:     defaultMaxDepth,
+		Doc:          -1,
+	}
+}
+
+func TestWindowsDrivePathIsNotGitRef(t *testing.T) {
+	tests := []struct {
+		input     string
+		drivePath bool
+		gitRef    bool
+	}{
+		{`C:\secrets\a.enc.yaml`, true, false},
+		{`d:/secrets/a.enc.yaml`, true, false},
+		{`C:\secrets\*.yaml`, true, false},
+		{"HEAD:secrets.enc.yaml", false, true},
+		{"main:config/app.enc.json", false, true},
+		{"a.enc.yaml", false, false},
+		{"1:a.enc.yaml", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.drivePath, isWindowsDrivePath(tt.input))
+			assert.Equal(t, tt.gitRef, isGitRef(tt.input))
+		})
+	}
+}
+
+func TestDriveRelativePathOnlyOnWindows(t *testing.T) {
+	// C:secrets.enc.yaml is relative to the current directory of drive C
+	// on Windows, and a revision named C elsewhere
+	windows := runtime.GOOS == "windows"
+	assert.Equal(t, windows, isWindowsDrivePath("C:secrets.enc.yaml"))
+	assert.Equal(t, !windows, isGitRef("C:secrets.enc.yaml"))
+}
+
+func TestYAMLMergeKeysCompareLikeInlinedValues(t *testing.T) {
+	merged := []byte(`defaults: &defaults
+  adapter: postgres
+  host: localhost
+  pool: 5
+production:
+  <<: *defaults
+  host: db.internal
+  password: secret
+`)
+	inlined := []byte(`defaults:
+  adapter: postgres
+  host: localhost
+  pool: 5
+production:
+  adapter: postgres
+  host: db.internal
+  pool: 5
+  password: secret
+`)
+
+	// Both decoders used by runDiff expand merge keys
+	var data1, data2 interface{}
+	require.NoError(t, yaml.Unmarshal(merged, &data1))
+	require.NoError(t, yaml.Unmarshal(inlined, &data2))
+	assert.False(t, Compare(data1, data2, testOptions()).HasChanges())
+
+	data1, data2 = nil, nil
+	_, err := decodeYAMLLastWins(merged, &data1)
+	require.NoError(t, err)
+	_, err = decodeYAMLLastWins(inlined, &data2)
+	require.NoError(t, err)
+	assert.False(t, Compare(data1, data2, testOptions()).HasChanges())
+}
+
+func TestEnvEmptyValue(t *testing.T) {
+	parse := func(content string) envFile {
+		env, _, err := parseEnv([]byte(content))
+		require.NoError(t, err)
+		return env
+	}
+	empty := parse("KEY=\n")
+	set := parse("KEY=value\n")
+	absent := parse("OTHER=1\n")
+
+	require.Equal(t, []string{"KEY"}, empty.Keys)
+	assert.Equal(t, "", empty.Values["KEY"])
+	full, err := formatFull(empty, "env")
+	require.NoError(t, err)
+	assert.Equal(t, "KEY=\n", full)
+
+	result := Compare(empty.document(), set.document(), testOptions())
+	assert.Equal(t, []ModifiedKey{{Key: "KEY", OldValue: "", NewValue: "value"}}, result.Modified)
+	assert.Empty(t, result.Added)
+	assert.Empty(t, result.Removed)
+
+	result = Compare(empty.document(), absent.document(), testOptions())
+	assert.Equal(t, []string{"KEY"}, result.Removed)
+	assert.Empty(t, result.Modified)
+
+	result = Compare(absent.document(), empty.document(), testOptions())
+	assert.Equal(t, []string{"KEY"}, result.Added)
+	assert.Equal(t, "", result.Values["KEY"])
+}
+
+func TestCompareIsStableAcrossRuns(t *testing.T) {
+	data1 := make(map[string]interface{})
+	data2 := make(map[string]interface{})
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		// Equal nested maps, built separately so only their contents match
+		data1[key] = map[string]interface{}{"a": i, "b": []interface{}{"x", i}, "c": map[string]interface{}{"d": key}}
+		data2[key] = map[string]interface{}{"c": map[string]interface{}{"d": key}, "b": []interface{}{"x", i}, "a": i}
+	}
+	data2["key007"] = map[string]interface{}{"a": 7, "b": []interface{}{"x", 7}, "c": map[string]interface{}{"d": "changed"}}
+	delete(data2, "key100")
+	data2["key200"] = "new"
+
+	options := testOptions()
+	first, err := compareData(data1, data2, options)
+	require.NoError(t, err)
+	assert.Equal(t, "! key007.c.d\n+ key200\n- key100.a\n- key100.b[0]\n- key100.b[1]\n- key100.c.d\n", first)
+
+	for i := 0; i < 50; i++ {
+		output, err := compareData(data1, data2, options)
+		require.NoError(t, err)
+		require.Equal(t, first, output)
+	}
+
+	// Whole subtrees compare by value, never by their string form
+	for i := 0; i < 50; i++ {
+		require.True(t, valuesEqual(data1["key001"], data2["key001"]))
+	}
+}
+
+func TestKeyPathRoundTrip(t *testing.T) {
+	keys := [][]string{
+		{"my.service", "port"},
+		{"my", "service", "port"},
+		{"list[0]", "name"},
+		{"a]b", "c[d"},
+		{`back\slash`, `trailing\`},
+		{"a/b", "c~d"},
+	}
+
+	for _, style := range []string{pathStyleDot, pathStylePointer} {
+		for _, segments := range keys {
+			path := ""
+			for _, segment := range segments {
+				path = sopsdiff.JoinKeyPath(path, segment, style)
+			}
+			assert.Equal(t, segments, splitKeyPath(path, style), "%s path %q", style, path)
+		}
+	}
+}
+
+func TestFlattenEscapesKeySeparators(t *testing.T) {
+	data := map[string]interface{}{
+		"my.service": "dotted",
+		"my":         map[string]interface{}{"service": "nested"},
+		"a[0]":       "bracketed",
+		"a":          []interface{}{"indexed"},
+		`x\`:         "backslash",
+	}
+
+	flat := make(map[string]interface{})
+	sopsdiff.FlattenDocument(data, flat, pathStyleDot)
+	assert.Equal(t, map[string]interface{}{
+		`my\.service`: "dotted",
+		"my.service":  "nested",
+		`a\[0\]`:      "bracketed",
+		"a[0]":        "indexed",
+		`x\\`:         "backslash",
+	}, flat)
+
+	flat = make(map[string]interface{})
+	sopsdiff.FlattenDocument(data, flat, pathStylePointer)
+	assert.Equal(t, map[string]interface{}{
+		"/my.service": "dotted",
+		"/my/service": "nested",
+		"/a[0]":       "bracketed",
+		"/a/0":        "indexed",
+		`/x\`:         "backslash",
+	}, flat)
+}
+
+func TestNullEmptyAndMissingValues(t *testing.T) {
+	null := map[string]interface{}{"key": nil}
+	empty := map[string]interface{}{"key": ""}
+	missing := map[string]interface{}{}
+
+	tests := []struct {
+		name         string
+		data1, data2 interface{}
+		summary      string
+	}{
+		{"empty to null", empty, null, "! key (set to null)\n"},
+		{"null to empty", null, empty, "! key (set to empty string)\n"},
+		{"null removed", null, missing, "- key\n"},
+		{"null added", missing, null, "+ key\n"},
+		{"empty removed", empty, missing, "- key\n"},
+		{"null unchanged", null, map[string]interface{}{"key": nil}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Values set to empty are warned about on stderr
+			var summary string
+			captureStderr(t, func() {
+				var err error
+				summary, err = compareData(tt.data1, tt.data2, testOptions())
+				require.NoError(t, err)
+			})
+			assert.Equal(t, tt.summary, summary)
+		})
+	}
+
+	// An added null is kept apart from an added empty string
+	result := Compare(missing, null, testOptions())
+	assert.Equal(t, nullValue{}, result.Values["key"])
+}
+
+func TestTopLevelArrayAndScalarDocuments(t *testing.T) {
+	decode := func(content string) interface{} {
+		data, err := unmarshalJSON([]byte(content))
+		require.NoError(t, err)
+		return data
+	}
+
+	flat := make(map[string]interface{})
+	sopsdiff.FlattenDocument(decode(`["a","b"]`), flat, pathStyleDot)
+	assert.Equal(t, map[string]interface{}{"[0]": "a", "[1]": "b"}, flat)
+
+	flat = make(map[string]interface{})
+	sopsdiff.FlattenDocument(decode(`["a","b"]`), flat, pathStylePointer)
+	assert.Equal(t, map[string]interface{}{"/0": "a", "/1": "b"}, flat)
+
+	flat = make(map[string]interface{})
+	sopsdiff.FlattenDocument(decode(`42`), flat, pathStyleDot)
+	assert.Equal(t, map[string]interface{}{rootKeyPath: int64(42)}, flat)
+
+	summary, err := compareData(decode(`["a","b"]`), decode(`["a","c","d"]`), testOptions())
+	require.NoError(t, err)
+	assert.Equal(t, "! [1]\n+ [2]\n", summary)
+
+	summary, err = compareData(decode(`42`), decode(`43`), testOptions())
+	require.NoError(t, err)
+	assert.Equal(t, "! .\n", summary)
+}
+
+// summarizeFiles runs a --summary comparison of two files with the given
+// contents and returns the report, after applying configure to the options.
+// The first populated file is a plaintext reference, and the other one is
+// compared as a decrypted file, so nothing is decrypted.
+func summarizeFiles(t *testing.T, name1, content1, name2, content2 string, configure ...func(*DiffOptions)) string {
+	t.Helper()
+	dir := t.TempDir()
+	path1 := filepath.Join(dir, name1)
+	path2 := filepath.Join(dir, name2)
+	require.NoError(t, os.WriteFile(path1, []byte(content1), 0600))
+	require.NoError(t, os.WriteFile(path2, []byte(content2), 0600))
+
+	options := testOptions()
+	options.SummaryMode = true
+	options.SummaryOut = filepath.Join(dir, "summary.txt")
+	options.NoKeyCheck = true
+	if !isBlankDocument([]byte(content1)) {
+		options.PlaintextReference = path1
+	} else if !isBlankDocument([]byte(content2)) {
+		options.PlaintextReference = path2
+	}
+	for _, fn := range configure {
+		fn(&options)
+	}
+
+	captureStderr(t, func() {
+		require.NoError(t, runDiff(path1, path2, options))
+	})
+	summary, err := os.ReadFile(options.SummaryOut)
+	require.NoError(t, err)
+	return string(summary)
+}
+
+func TestEmptyFiles(t *testing.T) {
+	assert.Equal(t, "No changes detected in keys\n", summarizeFiles(t, "a.yaml", "", "b.yaml", ""))
+	assert.Equal(t, "No changes detected in keys\n", summarizeFiles(t, "a.yaml", "", "b.yaml", " \n\t\n"))
+	assert.Equal(t, "No changes detected in keys\n", summarizeFiles(t, "a.json", "\n", "b.json", ""))
+
+	header := "Summary of key changes:\n! = modified key, + = added key, - = removed key\n--------------------------------------\n"
+	assert.Equal(t, header+"+ db.password\n+ port\n",
+		summarizeFiles(t, "a.yaml", "", "b.yaml", "db:\n  password: secret\nport: 5432\n"))
+	assert.Equal(t, header+"- token\n",
+		summarizeFiles(t, "a.json", `{"token": "x"}`, "b.json", "  \n"))
+	assert.Equal(t, header+"+ TOKEN\n",
+		summarizeFiles(t, "a.env", "", "b.env", "TOKEN=x\n"))
+}
+
+func TestCheckDepth(t *testing.T) {
+	nest := func(depth int) interface{} {
+		var data interface{} = "leaf"
+		for i := 0; i < depth; i++ {
+			data = map[string]interface{}{"k": data}
+		}
+		return data
+	}
+
+	assert.NoError(t, checkDepth(nest(defaultMaxDepth), defaultMaxDepth))
+	err := checkDepth(nest(defaultMaxDepth+1), defaultMaxDepth)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--max-depth 1000")
+
+	// A pathologically nested document trips the limit without panicking
+	assert.Error(t, checkDepth(nest(100000), defaultMaxDepth))
+	assert.NoError(t, checkDepth(nest(5000), 0))
+
+	data, err := unmarshalJSON([]byte(strings.Repeat("[", 5000) + strings.Repeat("]", 5000)))
+	require.NoError(t, err)
+	assert.Error(t, checkDepth(data, defaultMaxDepth))
+}
+
+func TestSummaryKeysStartingWithMarkers(t *testing.T) {
+	data1 := map[string]interface{}{"+feature": map[string]interface{}{"enabled": false}, "-legacy": "on"}
+	data2 := map[string]interface{}{"+feature": map[string]interface{}{"enabled": true}, "!new": "x"}
+
+	summary, err := compareData(data1, data2, testOptions())
+	require.NoError(t, err)
+	assert.Equal(t, "! +feature.enabled\n+ !new\n- -legacy\n", summary)
+
+	// --no-legend separates the marker from the key with a tab
+	options := testOptions()
+	options.NoLegend = true
+	summary, err = compareData(data1, data2, options)
+	require.NoError(t, err)
+	assert.Equal(t, "!\t+feature.enabled\n+\t!new\n-\t-legacy\n", summary)
+
+	for _, line := range strings.Split(strings.TrimSuffix(summary, "\n"), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		require.Len(t, fields, 2)
+		assert.Contains(t, []string{"+feature.enabled", "!new", "-legacy"}, fields[1])
+	}
+}
+
+func TestSubcommandOptionsUseMaxDepth(t *testing.T) {
+	defer func(savedDepth int, savedSize string) { maxDepth, maxFileSize = savedDepth, savedSize }(maxDepth, maxFileSize)
+
+	maxFileSize = defaultMaxFileSize
+	maxDepth = 5
+	options, err := subcommandOptions()
+	require.NoError(t, err)
+	assert.Equal(t, 5, options.MaxDepth)
+
+	maxDepth = -1
+	_, err = subcommandOptions()
+	assert.Error(t, err)
+}
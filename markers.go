@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// markerSet maps change kinds to the markers printed in the summary, set with
+// --marker-added, --marker-removed and --marker-modified. Kinds without an
+// entry, and every kind of a nil set, print as their default marker.
+type markerSet map[string]string
+
+// newMarkerSet validates the marker flags. Markers must be non-empty, must
+// not contain spaces or control characters, which separate the marker from
+// the key, and must differ from each other and from the unchanged marker.
+func newMarkerSet(added, removed, modified string) (markerSet, error) {
+	markers := markerSet{changeAdded: added, changeRemoved: removed, changeModified: modified, changeUnchanged: changeUnchanged}
+	flags := []struct {
+		flag, kind string
+	}{{"--marker-added", changeAdded}, {"--marker-removed", changeRemoved}, {"--marker-modified", changeModified}}
+
+	used := map[string]string{changeUnchanged: "the unchanged marker"}
+	for _, f := range flags {
+		marker := markers[f.kind]
+		if marker == "" || strings.IndexFunc(marker, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+			return nil, fmt.Errorf("invalid %s %q: must be non-empty, without spaces or control characters", f.flag, marker)
+		}
+		if other, ok := used[marker]; ok {
+			return nil, fmt.Errorf("invalid %s %q: already used by %s", f.flag, marker, other)
+		}
+		used[marker] = f.flag
+	}
+
+	return markers, nil
+}
+
+// marker returns the summary marker of a change kind
+func (m markerSet) marker(kind string) string {
+	if marker, ok := m[kind]; ok {
+		return marker
+	}
+	return kind
+}
+
+// legend describes the markers above the summary
+func (m markerSet) legend(showUnchanged bool) string {
+	legend := fmt.Sprintf("%s = modified key, %s = added key, %s = removed key",
+		m.marker(changeModified), m.marker(changeAdded), m.marker(changeRemoved))
+	if showUnchanged {
+		legend += fmt.Sprintf(", %s = unchanged key", m.marker(changeUnchanged))
+	}
+	return legend
+}
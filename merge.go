@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+	"gopkg.in/yaml.v3"
+)
+
+// mergeSide is one version of a value in a three-way merge. A key that is
+// missing from a version is represented with present set to false.
+type mergeSide struct {
+	value   interface{}
+	present bool
+}
+
+// sameSide reports whether two versions of a value are identical, including
+// both being absent
+func sameSide(a, b mergeSide) bool {
+	return a.present == b.present && (!a.present || reflect.DeepEqual(a.value, b.value))
+}
+
+// mergeValues merges one value key by key. Changes made on only one side are
+// taken, and values changed differently on both sides are recorded as
+// conflicts. Two results are returned, resolving every conflict in favor of
+// local and of remote respectively; they are equal when nothing conflicts.
+func mergeValues(path string, base, local, remote mergeSide, conflicts *[]string) (mergeSide, mergeSide) {
+	switch {
+	case sameSide(local, remote):
+		return local, local
+	case sameSide(local, base):
+		return remote, remote
+	case sameSide(remote, base):
+		return local, local
+	}
+
+	localMap, localIsMap := local.value.(map[string]interface{})
+	remoteMap, remoteIsMap := remote.value.(map[string]interface{})
+	if local.present && remote.present && localIsMap && remoteIsMap {
+		baseMap, _ := base.value.(map[string]interface{})
+
+		keys := make(map[string]bool)
+		for _, m := range []map[string]interface{}{baseMap, localMap, remoteMap} {
+			for k := range m {
+				keys[k] = true
+			}
+		}
+
+		localChoice := make(map[string]interface{})
+		remoteChoice := make(map[string]interface{})
+		for _, k := range sortedKeySet(keys) {
+			side := func(m map[string]interface{}) mergeSide {
+				v, ok := m[k]
+				return mergeSide{value: v, present: ok}
+			}
+
+			l, r := mergeValues(sopsdiff.JoinKeyPath(path, k, pathStyleDot), side(baseMap), side(localMap), side(remoteMap), conflicts)
+			if l.present {
+				localChoice[k] = l.value
+			}
+			if r.present {
+				remoteChoice[k] = r.value
+			}
+		}
+
+		return mergeSide{value: localChoice, present: true}, mergeSide{value: remoteChoice, present: true}
+	}
+
+	if path == "" {
+		path = rootKeyPath
+	}
+	*conflicts = append(*conflicts, path)
+	return local, remote
+}
+
+// sortedKeySet returns the members of a set in sorted order
+func sortedKeySet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeDocuments performs a key-level three-way merge of decrypted YAML, JSON
+// or ENV documents. The merged values are written back into the local file,
+// keeping its comments, key order and further YAML documents; keys that
+// changed differently on both sides are wrapped in conflict markers and
+// returned in conflicts. Versions nesting deeper than maxDepth are refused.
+func mergeDocuments(base, local, remote []byte, format string, maxDepth int) ([]byte, []string, error) {
+	var docs [3]*mergeDocument
+	for i, content := range [][]byte{base, local, remote} {
+		doc, err := parseMergeDocument(content, format)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := doc.checkDepth(maxDepth); err != nil {
+			return nil, nil, err
+		}
+		docs[i] = doc
+	}
+
+	count := len(docs[1].values)
+	if len(docs[0].values) != count || len(docs[2].values) != count {
+		return nil, nil, fmt.Errorf("the versions hold different numbers of YAML documents")
+	}
+
+	var conflicts []string
+	localChoice := make([]interface{}, count)
+	remoteChoice := make([]interface{}, count)
+	for i := 0; i < count; i++ {
+		var docConflicts []string
+		l, r := mergeValues("",
+			mergeSide{value: docs[0].values[i], present: true},
+			mergeSide{value: docs[1].values[i], present: true},
+			mergeSide{value: docs[2].values[i], present: true},
+			&docConflicts)
+		localChoice[i], remoteChoice[i] = l.value, r.value
+
+		for _, path := range docConflicts {
+			conflicts = append(conflicts, documentKeyPath(i, count, path))
+		}
+	}
+
+	localText, err := docs[1].render(localChoice, docs[2])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(conflicts) == 0 {
+		return []byte(localText), nil, nil
+	}
+
+	remoteText, err := docs[1].render(remoteChoice, docs[2])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []byte(insertConflictMarkers(localText, remoteText)), conflicts, nil
+}
+
+// documentKeyPath names a key of one document of a multi-document YAML file,
+// counting documents from 0 like --doc
+func documentKeyPath(index, count int, path string) string {
+	if count == 1 {
+		return path
+	}
+	return fmt.Sprintf("document %d: %s", index, path)
+}
+
+// mergeDocument is a decrypted YAML, JSON or ENV file prepared for a
+// key-level merge. Its decoded values are merged, and the result is written
+// back into the file as it was parsed rather than rendered afresh, so
+// comments, key order, quoting and further YAML documents survive.
+type mergeDocument struct {
+	format  string
+	content []byte
+	// values holds one decoded value per document
+	values []interface{}
+	// nodes holds the parsed YAML or JSON documents, nil for a blank file
+	nodes []*yaml.Node
+	// lines holds the lines of an ENV file
+	lines []string
+}
+
+// parseMergeDocument parses a decrypted YAML, JSON or ENV file for a
+// key-level merge. A blank file holds a single empty document.
+func parseMergeDocument(content []byte, format string) (*mergeDocument, error) {
+	doc := &mergeDocument{format: format, content: content}
+
+	switch format {
+	case "yaml", "json":
+		if isBlankDocument(content) {
+			doc.values = []interface{}{nil}
+			doc.nodes = []*yaml.Node{nil}
+			return doc, nil
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		for {
+			var node yaml.Node
+			err := decoder.Decode(&node)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var value interface{}
+			if err := node.Decode(&value); err != nil {
+				return nil, err
+			}
+			doc.nodes = append(doc.nodes, &node)
+			doc.values = append(doc.values, value)
+		}
+
+		// JSON values are decoded as the diff decodes them, so numbers
+		// compare by value, while the nodes keep the member order
+		if format == "json" {
+			if len(doc.nodes) != 1 {
+				return nil, fmt.Errorf("expected a single JSON document, found %d", len(doc.nodes))
+			}
+			value, err := unmarshalJSON(content)
+			if err != nil {
+				return nil, err
+			}
+			doc.values[0] = value
+		}
+		return doc, nil
+	case "env":
+		env, _, err := parseEnv(content)
+		if err != nil {
+			return nil, err
+		}
+		doc.values = []interface{}{env.document()}
+		doc.lines = strings.Split(string(content), "\n")
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("key-level merge is not supported for %s files", format)
+	}
+}
+
+// checkDepth applies --max-depth to every document of the file, before the
+// merge recurses through them
+func (d *mergeDocument) checkDepth(maxDepth int) error {
+	for _, value := range d.values {
+		if err := checkDepth(value, maxDepth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeDocument decodes a decrypted YAML, JSON or ENV document into a
+// single value. ENV files are decoded into a map like the other formats.
+func decodeDocument(content []byte, format string) (interface{}, error) {
+	doc, err := parseMergeDocument(content, format)
+	if err != nil {
+		return nil, err
+	}
+	return doc.values[0], nil
+}
+
+// render returns the file with merged values, one per document, in place of
+// its own. A changed value is copied from source when it holds the same
+// value there, bringing its comments and quoting along, and written afresh
+// otherwise.
+func (d *mergeDocument) render(merged []interface{}, source *mergeDocument) (string, error) {
+	var text string
+	if d.format == "env" {
+		text = d.renderEnv(merged[0], source)
+	} else {
+		var err error
+		if text, err = d.renderNodes(merged, source); err != nil {
+			return "", err
+		}
+	}
+
+	// Anchors, aliases and merge keys can make a patched file decode to
+	// other values, which must never be encrypted as the result
+	check, err := parseMergeDocument([]byte(text), d.format)
+	if err != nil || len(check.values) != len(merged) {
+		return "", fmt.Errorf("the merged values could not be written back into the %s file", d.format)
+	}
+	for i := range merged {
+		if !sameMergeValue(d.format, check.values[i], merged[i]) {
+			return "", fmt.Errorf("the merged values could not be written back into the %s file", d.format)
+		}
+	}
+
+	return text, nil
+}
+
+// sameMergeValue reports whether a rendered document decodes to the merged
+// value. ENV files only hold strings, so their values compare as text.
+func sameMergeValue(format string, rendered, merged interface{}) bool {
+	if format != "env" {
+		return valuesEqual(rendered, merged)
+	}
+
+	renderedMap, _ := rendered.(map[string]interface{})
+	mergedMap, _ := merged.(map[string]interface{})
+	if len(renderedMap) != len(mergedMap) {
+		return false
+	}
+	for k, v := range mergedMap {
+		r, ok := renderedMap[k]
+		if !ok || envValue(r) != envValue(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// renderNodes writes merged values into a fresh parse of a YAML or JSON file
+func (d *mergeDocument) renderNodes(merged []interface{}, source *mergeDocument) (string, error) {
+	fresh, err := parseMergeDocument(d.content, d.format)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoded := false
+	for i, node := range fresh.nodes {
+		var src *yaml.Node
+		var srcValue interface{}
+		if source != nil && i < len(source.nodes) && source.nodes[i] != nil && len(source.nodes[i].Content) > 0 {
+			src, srcValue = source.nodes[i].Content[0], source.values[i]
+		}
+
+		if node == nil || len(node.Content) == 0 {
+			if merged[i] == nil {
+				continue
+			}
+			root, err := mergeValueNode(merged[i], src, srcValue)
+			if err != nil {
+				return "", err
+			}
+			node = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+		} else if err := patchNode(node.Content[0], fresh.values[i], merged[i], src, srcValue); err != nil {
+			return "", err
+		}
+
+		if d.format == "json" {
+			writeJSONNode(&buffer, node.Content[0], "")
+			buffer.WriteString("\n")
+			continue
+		}
+		clearMergeKeyTags(node)
+		if err := encoder.Encode(node); err != nil {
+			return "", err
+		}
+		encoded = true
+	}
+	if encoded {
+		if err := encoder.Close(); err != nil {
+			return "", err
+		}
+	}
+
+	return buffer.String(), nil
+}
+
+// patchNode makes node, which holds current, hold merged instead. Mappings
+// are patched key by key, so untouched keys keep their comments and order;
+// other values are replaced whole.
+func patchNode(node *yaml.Node, current, merged interface{}, src *yaml.Node, srcValue interface{}) error {
+	if valuesEqual(current, merged) {
+		return nil
+	}
+
+	currentMap, currentIsMap := current.(map[string]interface{})
+	mergedMap, mergedIsMap := merged.(map[string]interface{})
+	if !currentIsMap || !mergedIsMap || node.Kind != yaml.MappingNode {
+		replacement, err := mergeValueNode(merged, src, srcValue)
+		if err != nil {
+			return err
+		}
+		if replacement != src {
+			replacement.HeadComment = node.HeadComment
+			replacement.LineComment = node.LineComment
+			replacement.FootComment = node.FootComment
+		}
+		*node = *replacement
+		return nil
+	}
+
+	srcMap, _ := srcValue.(map[string]interface{})
+	if src != nil && src.Kind != yaml.MappingNode {
+		src = nil
+	}
+
+	content := make([]*yaml.Node, 0, len(node.Content))
+	written := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		// Merge keys are kept as they are, and the keys they bring in
+		// are overridden below when they change
+		if _, ok := currentMap[key.Value]; !ok || key.Kind != yaml.ScalarNode || key.ShortTag() == "!!merge" {
+			content = append(content, key, value)
+			continue
+		}
+
+		written[key.Value] = true
+		newValue, ok := mergedMap[key.Value]
+		if !ok {
+			continue
+		}
+		if err := patchNode(value, currentMap[key.Value], newValue, mappingValue(src, key.Value), srcMap[key.Value]); err != nil {
+			return err
+		}
+		content = append(content, key, value)
+	}
+
+	// Added keys follow in the order of src, then sorted
+	var added []string
+	for _, k := range mappingKeys(src) {
+		if _, ok := mergedMap[k]; ok {
+			added = append(added, k)
+		}
+	}
+	var rest []string
+	for k := range mergedMap {
+		rest = append(rest, k)
+	}
+	sort.Strings(rest)
+	added = append(added, rest...)
+
+	for _, k := range added {
+		if written[k] {
+			continue
+		}
+		written[k] = true
+		if old, ok := currentMap[k]; ok && valuesEqual(old, mergedMap[k]) {
+			continue
+		}
+
+		keyNode := mappingKey(src, k)
+		valueNode, err := mergeValueNode(mergedMap[k], mappingValue(src, k), srcMap[k])
+		if err != nil {
+			return err
+		}
+		if keyNode == nil || valueNode != mappingValue(src, k) {
+			keyNode = &yaml.Node{}
+			if err := keyNode.Encode(k); err != nil {
+				return err
+			}
+		}
+		content = append(content, keyNode, valueNode)
+	}
+
+	node.Content = content
+	return nil
+}
+
+// clearMergeKeyTags drops the explicit tag of merge keys, which the YAML
+// encoder would otherwise write out as !!merge <<
+func clearMergeKeyTags(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Kind == yaml.ScalarNode && key.Tag == "!!merge" {
+				key.Tag = ""
+			}
+		}
+	}
+	for _, child := range node.Content {
+		clearMergeKeyTags(child)
+	}
+}
+
+// mergeValueNode returns src when it holds value, and a new node holding
+// value otherwise
+func mergeValueNode(value interface{}, src *yaml.Node, srcValue interface{}) (*yaml.Node, error) {
+	if src != nil && valuesEqual(srcValue, value) {
+		return src, nil
+	}
+
+	node := &yaml.Node{}
+	if err := node.Encode(value); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// mappingKeys returns the plain keys of a mapping node in order
+func mappingKeys(node *yaml.Node) []string {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	var keys []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i]; key.Kind == yaml.ScalarNode && key.ShortTag() != "!!merge" {
+			keys = append(keys, key.Value)
+		}
+	}
+	return keys
+}
+
+// mappingKey returns the key node of a mapping node for key, or nil
+func mappingKey(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if k := node.Content[i]; k.Kind == yaml.ScalarNode && k.ShortTag() != "!!merge" && k.Value == key {
+			return k
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value node of a mapping node for key, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if k := node.Content[i]; k.Kind == yaml.ScalarNode && k.ShortTag() != "!!merge" && k.Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// writeJSONNode writes a node parsed from a JSON document back as JSON,
+// indented like formatFull, keeping the member order and the text of numbers
+func writeJSONNode(buffer *bytes.Buffer, node *yaml.Node, indent string) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		writeJSONNode(buffer, node.Alias, indent)
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close, step := "{", "}", 2
+		if node.Kind == yaml.SequenceNode {
+			open, close, step = "[", "]", 1
+		}
+		if len(node.Content) == 0 {
+			buffer.WriteString(open + close)
+			return
+		}
+
+		buffer.WriteString(open + "\n")
+		for i := 0; i < len(node.Content); i += step {
+			if i > 0 {
+				buffer.WriteString(",\n")
+			}
+			buffer.WriteString(indent + "  ")
+			if step == 2 {
+				writeJSONString(buffer, node.Content[i].Value)
+				buffer.WriteString(": ")
+			}
+			writeJSONNode(buffer, node.Content[i+step-1], indent+"  ")
+		}
+		buffer.WriteString("\n" + indent + close)
+	default:
+		switch node.ShortTag() {
+		case "!!str":
+			writeJSONString(buffer, node.Value)
+		case "!!null":
+			buffer.WriteString("null")
+		default:
+			buffer.WriteString(node.Value)
+		}
+	}
+}
+
+// writeJSONString writes s as a JSON string, without escaping HTML
+func writeJSONString(buffer *bytes.Buffer, s string) {
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)
+	// Encode ends the value with a newline
+	buffer.Truncate(buffer.Len() - 1)
+}
+
+// renderEnv writes merged variables back into the lines of an ENV file, so
+// comments, order and quoting are kept. A changed variable takes its line
+// from source when it holds the same value there.
+func (d *mergeDocument) renderEnv(merged interface{}, source *mergeDocument) string {
+	current, _ := d.values[0].(map[string]interface{})
+	mergedMap, _ := merged.(map[string]interface{})
+
+	// Only the last definition of a variable counts
+	lastLine := func(lines []string) (map[string]int, []string) {
+		last := make(map[string]int)
+		var order []string
+		for i, line := range lines {
+			if key, _, ok := parseEnvLine(line); ok {
+				if _, seen := last[key]; !seen {
+					order = append(order, key)
+				}
+				last[key] = i
+			}
+		}
+		return last, order
+	}
+
+	var sourceValues map[string]interface{}
+	var sourceLast map[string]int
+	var sourceOrder []string
+	if source != nil {
+		sourceValues, _ = source.values[0].(map[string]interface{})
+		sourceLast, sourceOrder = lastLine(source.lines)
+	}
+	lineFor := func(key string) string {
+		if i, ok := sourceLast[key]; ok && envValue(sourceValues[key]) == envValue(mergedMap[key]) {
+			return source.lines[i]
+		}
+		return key + "=" + envValue(mergedMap[key])
+	}
+
+	last, _ := lastLine(d.lines)
+	var lines []string
+	for i, line := range d.lines {
+		key, _, ok := parseEnvLine(line)
+		if !ok {
+			lines = append(lines, line)
+			continue
+		}
+		if _, keep := mergedMap[key]; !keep {
+			continue
+		}
+		if i == last[key] && envValue(current[key]) != envValue(mergedMap[key]) {
+			line = lineFor(key)
+		}
+		lines = append(lines, line)
+	}
+
+	// Added variables follow in the order of source, then sorted, before
+	// the final newline
+	trailing := len(lines) > 0 && lines[len(lines)-1] == ""
+	if trailing {
+		lines = lines[:len(lines)-1]
+	}
+
+	var rest []string
+	for k := range mergedMap {
+		rest = append(rest, k)
+	}
+	sort.Strings(rest)
+	added := make(map[string]bool)
+	for _, k := range append(sourceOrder, rest...) {
+		if _, ok := mergedMap[k]; !ok || added[k] {
+			continue
+		}
+		added[k] = true
+		if _, ok := current[k]; !ok {
+			lines = append(lines, lineFor(k))
+		}
+	}
+
+	text := strings.Join(lines, "\n")
+	if trailing {
+		text += "\n"
+	}
+	return text
+}
+
+// envValue renders a merged value as the text of an ENV variable
+func envValue(v interface{}) string {
+	return fmt.Sprintf("%v", v)
+}
+
+// insertConflictMarkers combines two renderings that only differ in their
+// conflicting keys, wrapping each differing block in Git conflict markers
+func insertConflictMarkers(localText, remoteText string) string {
+	localLines := splitLinesKeepEnds(localText)
+	remoteLines := splitLinesKeepEnds(remoteText)
+
+	var result strings.Builder
+	matcher := difflib.NewMatcher(localLines, remoteLines)
+	for _, op := range matcher.GetOpCodes() {
+		if op.Tag == 'e' {
+			result.WriteString(strings.Join(localLines[op.I1:op.I2], ""))
+			continue
+		}
+
+		result.WriteString("<<<<<<< LOCAL\n")
+		result.WriteString(strings.Join(localLines[op.I1:op.I2], ""))
+		result.WriteString("=======\n")
+		result.WriteString(strings.Join(remoteLines[op.J1:op.J2], ""))
+		result.WriteString(">>>>>>> REMOTE\n")
+	}
+
+	return result.String()
+}
+
+// splitLinesKeepEnds splits text into lines that keep their trailing newline,
+// adding one to the last line if it is missing
+func splitLinesKeepEnds(text string) []string {
+	if text == "" {
+		return nil
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	lines := strings.SplitAfter(text, "\n")
+	return lines[:len(lines)-1]
+}
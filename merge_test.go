@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeDocumentsKeepsYAMLCommentsAndDocuments(t *testing.T) {
+	base := "# settings\nz: 10\na: 1\n---\nother: doc\n"
+	local := "# settings\nz: 10\na: 20\n---\nother: doc\n"
+	remote := "# settings\nz: 10\na: 1\nb: new # added\n---\nother: doc\n"
+
+	merged, conflicts, err := mergeDocuments([]byte(base), []byte(local), []byte(remote), "yaml", defaultMaxDepth)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, "# settings\nz: 10\na: 20\nb: new # added\n---\nother: doc\n", string(merged))
+}
+
+func TestMergeDocumentsConflictInSecondDocument(t *testing.T) {
+	base := "a: 1\n---\nb: 1\n"
+	local := "a: 1\n---\nb: 2\n"
+	remote := "a: 1\n---\nb: 3\n"
+
+	merged, conflicts, err := mergeDocuments([]byte(base), []byte(local), []byte(remote), "yaml", defaultMaxDepth)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"document 1: b"}, conflicts)
+	assert.Equal(t, "a: 1\n---\n<<<<<<< LOCAL\nb: 2\n=======\nb: 3\n>>>>>>> REMOTE\n", string(merged))
+}
+
+func TestMergeDocumentsKeepsEnvLines(t *testing.T) {
+	base := "# comment\nA=\"x y\"\nB=1\n"
+	local := "# comment\nA=\"x y\"\nB=2\n"
+	remote := "# comment\nA=\"x y\"\nB=1\nC='z'\n"
+
+	merged, conflicts, err := mergeDocuments([]byte(base), []byte(local), []byte(remote), "env", defaultMaxDepth)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, "# comment\nA=\"x y\"\nB=2\nC='z'\n", string(merged))
+}
+
+func TestMergeDocumentsKeepsJSONOrder(t *testing.T) {
+	base := "{\n  \"z\": 1,\n  \"a\": 12345678901234567890\n}\n"
+	local := "{\n  \"z\": 2,\n  \"a\": 12345678901234567890\n}\n"
+	remote := "{\n  \"z\": 1,\n  \"a\": 12345678901234567890,\n  \"m\": \"<x>\"\n}\n"
+
+	merged, conflicts, err := mergeDocuments([]byte(base), []byte(local), []byte(remote), "json", defaultMaxDepth)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, "{\n  \"z\": 2,\n  \"a\": 12345678901234567890,\n  \"m\": \"<x>\"\n}\n", string(merged))
+}
+
+func TestMergeDocumentsRefusesUnwritableMerge(t *testing.T) {
+	// A key brought in by a merge key can't be removed from the mapping
+	base := "defaults: &d\n  x: 1\nsvc:\n  <<: *d\n  y: 1\n"
+	local := "defaults: &d\n  x: 1\nsvc:\n  <<: *d\n  y: 2\n"
+	remote := "defaults: &d\n  x: 1\nsvc:\n  y: 1\n"
+
+	_, _, err := mergeDocuments([]byte(base), []byte(local), []byte(remote), "yaml", defaultMaxDepth)
+	assert.Error(t, err)
+}
+
+func TestMergeDocumentsKeepsMergeKeys(t *testing.T) {
+	base := "defaults: &d\n    x: 1\nsvc:\n    <<: *d\n    y: 1\n"
+	local := "defaults: &d\n    x: 1\nsvc:\n    <<: *d\n    y: 2\n"
+	remote := "defaults: &d\n    x: 1\nsvc:\n    <<: *d\n    y: 1\nz: 1\n"
+
+	merged, conflicts, err := mergeDocuments([]byte(base), []byte(local), []byte(remote), "yaml", defaultMaxDepth)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, "defaults: &d\n    x: 1\nsvc:\n    <<: *d\n    y: 2\nz: 1\n", string(merged))
+}
+
+func TestMergeDocumentsRefusesDeepNesting(t *testing.T) {
+	deep := "a:\n  b:\n    c:\n      d: 1\n"
+	changed := "a:\n  b:\n    c:\n      d: 2\n"
+
+	_, _, err := mergeDocuments([]byte(deep), []byte(changed), []byte(deep), "yaml", 3)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--max-depth 3")
+
+	_, _, err = mergeDocuments([]byte(deep), []byte(changed), []byte(deep), "yaml", 4)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+// commonFormat picks the format both documents are rendered in when
+// --allow-format-mismatch compares files of different formats: the first
+// file's, unless that is ENV, which can't represent the nesting of the other
+// file
+func commonFormat(format1, format2 string) string {
+	if format1 == "env" {
+		return format2
+	}
+	return format1
+}
+
+// convertDocument re-renders a decrypted document from one format in
+// another, for --allow-format-mismatch and for an --input-type other than
+// --format. YAML, JSON, ENV and plist documents can be converted to YAML or
+// JSON.
+func convertDocument(content []byte, from, to string) ([]byte, error) {
+	if to != "yaml" && to != "json" {
+		return nil, fmt.Errorf("cannot render %s documents as %s: only yaml and json are supported", from, to)
+	}
+	if isBlankDocument(content) {
+		return content, nil
+	}
+
+	var data interface{}
+	var err error
+	switch from {
+	case "yaml", "json", "env":
+		data, err = decodeDocument(content, from)
+	case "plist":
+		data, err = parsePlist(content)
+	default:
+		return nil, fmt.Errorf("cannot render %s documents as %s: only yaml, json, env and plist documents can be converted", from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := formatFull(data, to)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
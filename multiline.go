@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+)
+
+// multilineStub stands in for multi-line values in the main diff with
+// --multiline-diff; the values themselves are diffed separately below it
+const multilineStub = "<multi-line value, diffed below>"
+
+// isMultiline reports whether a value is a string spanning several lines
+func isMultiline(v interface{}) bool {
+	str, ok := v.(string)
+	return ok && strings.Contains(strings.TrimSuffix(str, "\n"), "\n")
+}
+
+// stubMultilineValues returns a copy of decoded data with every multi-line
+// string replaced by multilineStub
+func stubMultilineValues(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			result[k] = stubMultilineValues(val)
+		}
+		return result
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, val := range v {
+			result[k] = stubMultilineValues(val)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			result[i] = stubMultilineValues(val)
+		}
+		return result
+	default:
+		if isMultiline(v) {
+			return multilineStub
+		}
+		return v
+	}
+}
+
+// multilineValueDiffs renders a unified diff of each changed multi-line
+// value, indented under its key path
+func multilineValueDiffs(data1, data2 interface{}, options DiffOptions) string {
+	flat1 := make(map[string]interface{})
+	flat2 := make(map[string]interface{})
+	sopsdiff.FlattenDocument(data1, flat1, options.PathStyle)
+	sopsdiff.FlattenDocument(data2, flat2, options.PathStyle)
+
+	var keys []string
+	for _, flat := range []map[string]interface{}{flat1, flat2} {
+		for k, v := range flat {
+			if isMultiline(v) && !valuesEqual(flat1[k], flat2[k]) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	colored := useColor(options)
+
+	// A key missing on one side diffs against an empty value
+	text := func(v interface{}) string {
+		if v == nil {
+			return ""
+		}
+		return fmt.Sprintf("%v", v)
+	}
+
+	var buffer strings.Builder
+	for i, k := range keys {
+		if i > 0 && keys[i-1] == k {
+			continue
+		}
+
+		diff := unifiedDiff(difflib.UnifiedDiff{
+			A:       splitLinesKeepEnds(text(flat1[k])),
+			B:       splitLinesKeepEnds(text(flat2[k])),
+			Context: 3,
+			Eol:     "\n",
+		}, options.DiffAlgorithm, options.IgnoreWhitespace)
+		if colored {
+			diff = colorDiff(diff, options.Colors, options.ColorMoved)
+		}
+
+		buffer.WriteString(k + ":\n")
+		for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			buffer.WriteString("    " + line + "\n")
+		}
+	}
+
+	return buffer.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// parseNDJSON decodes newline-delimited JSON into a slice with one element per
+// record, so records are compared by their position in the file. Blank lines
+// are skipped.
+func parseNDJSON(data []byte) ([]interface{}, error) {
+	records := []interface{}{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		record, err := unmarshalJSON([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// formatNDJSON renders records one per line. Object keys are sorted by
+// encoding/json, so equal records always render the same way.
+func formatNDJSON(data interface{}) (string, error) {
+	records, ok := data.([]interface{})
+	if !ok {
+		return "", fmt.Errorf("expected a list of records for NDJSON format, got %T", data)
+	}
+
+	var buffer strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return "", err
+		}
+		buffer.Write(line)
+		buffer.WriteString("\n")
+	}
+	return buffer.String(), nil
+}
+
+// isNDJSON reports whether content has more than one line and every line is a
+// JSON document on its own
+func isNDJSON(content []byte) bool {
+	lines := 0
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return false
+		}
+		lines++
+	}
+	return lines > 1
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// unmarshalJSON decodes a JSON document like json.Unmarshal, except that
+// integers decode as int64 or uint64, like YAML integers, rather than
+// float64. This keeps 10000000000 from printing as 1e+10 and large IDs from
+// losing precision, so JSON and YAML files holding the same data compare
+// equal.
+func unmarshalJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("invalid character after top-level value")
+	}
+
+	return normalizeJSONNumbers(value), nil
+}
+
+// normalizeJSONNumbers replaces the json.Number values of a decoded document
+// with int64 or uint64 when they are integers that fit, as the YAML decoder
+// does, and float64 for other numbers. Larger integers stay json.Number, so
+// they keep every digit.
+func normalizeJSONNumbers(data interface{}) interface{} {
+	switch v := data.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return n
+		}
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return v
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeJSONNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeJSONNumbers(value)
+		}
+	}
+	return data
+}
+
+// numericValue returns the exact value of a decoded number, so that 1, 1.0
+// and 1e0 compare equal whichever decoder produced them
+func numericValue(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case int64:
+		return new(big.Rat).SetInt64(n), true
+	case uint64:
+		return new(big.Rat).SetFrac(new(big.Int).SetUint64(n), big.NewInt(1)), true
+	case json.Number:
+		return new(big.Rat).SetString(n.String())
+	case float64:
+		// NaN and infinities have no exact value
+		if r := new(big.Rat).SetFloat64(n); r != nil {
+			return r, true
+		}
+	}
+	return nil, false
+}
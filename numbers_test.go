@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestJSONAndYAMLNumbersCompareEqual(t *testing.T) {
+	jsonData, err := unmarshalJSON([]byte(`{"n": 1, "big": 10000000000, "ratio": 0.1}`))
+	require.NoError(t, err)
+
+	var yamlData interface{}
+	require.NoError(t, yaml.Unmarshal([]byte("n: 1\nbig: 10000000000\nratio: 0.1\n"), &yamlData))
+	assert.False(t, Compare(jsonData, yamlData, testOptions()).HasChanges())
+
+	// 1 and 1.0 are the same number
+	floatData, err := unmarshalJSON([]byte(`{"n": 1.0, "big": 1e10, "ratio": 0.1}`))
+	require.NoError(t, err)
+	assert.False(t, Compare(jsonData, floatData, testOptions()).HasChanges())
+
+	allowMismatch := func(options *DiffOptions) { options.AllowFormatMismatch = true }
+	assert.Equal(t, "No changes detected in keys\n",
+		summarizeFiles(t, "a.json", `{"n":1}`, "b.yaml", "n: 1\n", allowMismatch))
+}
+
+func TestJSONLargeIntegersKeepPrecision(t *testing.T) {
+	// 2^53 + 1 is the first integer a float64 cannot hold
+	data1, err := unmarshalJSON([]byte(`{"id": 9007199254740993}`))
+	require.NoError(t, err)
+	data2, err := unmarshalJSON([]byte(`{"id": 9007199254740992}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{"id": int64(9007199254740993)}, data1)
+	result := Compare(data1, data2, testOptions())
+	assert.Equal(t, []ModifiedKey{{Key: "id", OldValue: int64(9007199254740993), NewValue: int64(9007199254740992)}}, result.Modified)
+
+	full, err := formatFull(data1, "json")
+	require.NoError(t, err)
+	assert.Equal(t, "{\n  \"id\": 9007199254740993\n}", full)
+}
+
+func TestJSONIntegersAboveInt64KeepPrecision(t *testing.T) {
+	// 2^63 fits uint64, as the YAML decoder reads it
+	jsonData, err := unmarshalJSON([]byte(`{"id": 9223372036854775808}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"id": uint64(9223372036854775808)}, jsonData)
+
+	var yamlData interface{}
+	require.NoError(t, yaml.Unmarshal([]byte("id: 9223372036854775808\n"), &yamlData))
+	assert.False(t, Compare(jsonData, yamlData, testOptions()).HasChanges())
+
+	// Beyond uint64 the literal is kept
+	data1, err := unmarshalJSON([]byte(`{"id": 123456789012345678901234}`))
+	require.NoError(t, err)
+	data2, err := unmarshalJSON([]byte(`{"id": 123456789012345678901235}`))
+	require.NoError(t, err)
+
+	result := Compare(data1, data2, testOptions())
+	require.Len(t, result.Modified, 1)
+	assert.Equal(t, "id", result.Modified[0].Key)
+
+	full, err := formatFull(data1, "json")
+	require.NoError(t, err)
+	assert.Equal(t, "{\n  \"id\": 123456789012345678901234\n}", full)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/pgp"
+)
+
+// networkKeyProviders names the SOPS key types that need a network service
+// to decrypt the data key, by their metadata identifier
+var networkKeyProviders = map[string]string{
+	"kms":      "AWS KMS",
+	"gcp_kms":  "GCP KMS",
+	"azure_kv": "Azure Key Vault",
+	"hc_vault": "HashiCorp Vault",
+}
+
+// isOfflineKey reports whether a master key can be decrypted without network
+// access. age and PGP keys are the only local ones.
+func isOfflineKey(key interface{ TypeToIdentifier() string }) bool {
+	switch key.TypeToIdentifier() {
+	case age.KeyTypeIdentifier, pgp.KeyTypeIdentifier:
+		return true
+	}
+	return false
+}
+
+// offlineContent prepares SOPS content for decryption under --offline. It
+// reads the sops metadata and fails fast when the data key can only be
+// recovered through a network key provider. Otherwise it returns the content
+// with the network keys removed, so SOPS never tries to reach them. Content
+// that does not load as an encrypted file is returned unchanged for
+// decrypt.Data to report.
+func offlineContent(content []byte, format string) ([]byte, error) {
+	store := common.StoreForFormat(formats.FormatFromString(format), config.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(content)
+	if err != nil {
+		return content, nil
+	}
+
+	// Key groups are all needed, unless Shamir secret sharing allows fewer
+	required := len(tree.Metadata.KeyGroups)
+	if threshold := tree.Metadata.ShamirThreshold; required > 1 && threshold > 0 && threshold < required {
+		required = threshold
+	}
+
+	providers := make(map[string]bool)
+	var groups []sops.KeyGroup
+	for _, group := range tree.Metadata.KeyGroups {
+		var offline sops.KeyGroup
+		for _, key := range group {
+			if isOfflineKey(key) {
+				offline = append(offline, key)
+			} else if name, ok := networkKeyProviders[key.TypeToIdentifier()]; ok {
+				providers[name] = true
+			}
+		}
+		if len(offline) > 0 {
+			groups = append(groups, offline)
+		}
+	}
+
+	if len(groups) < required {
+		names := make([]string, 0, len(providers))
+		for name := range providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("--offline: the data key can only be decrypted through %s, which needs network access; add an age or PGP recipient to the file to diff it offline",
+			strings.Join(names, ", "))
+	}
+
+	if len(providers) == 0 {
+		return content, nil
+	}
+
+	tree.Metadata.KeyGroups = groups
+	if len(groups) == 1 {
+		tree.Metadata.ShamirThreshold = 0
+	}
+	stripped, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		return nil, fmt.Errorf("--offline: error removing network key providers: %w", err)
+	}
+	return stripped, nil
+}
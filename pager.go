@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"golang.org/x/term"
+)
+
+// defaultPager is used when neither GIT_PAGER nor PAGER is set. Like git, it
+// quits if the output fits, keeps colors and doesn't clear the screen.
+const defaultPager = "less -RFX"
+
+// printOutput writes output to stdout, passing it through a pager when stdout
+// is a terminal and the output does not fit on the screen, or always with
+// --paginate
+func printOutput(output string, options DiffOptions) error {
+	if options.NoPager || !isatty.IsTerminal(os.Stdout.Fd()) {
+		fmt.Print(output)
+		return nil
+	}
+
+	if !options.Paginate {
+		_, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil || height <= 0 || strings.Count(output, "\n") < height {
+			fmt.Print(output)
+			return nil
+		}
+	}
+
+	return runPager(output)
+}
+
+// pagerCommand picks the pager the way git does: $GIT_PAGER, then $PAGER,
+// then less. A variable that is set but empty still counts, and disables
+// paging.
+func pagerCommand() string {
+	for _, name := range []string{"GIT_PAGER", "PAGER"} {
+		if pager, ok := os.LookupEnv(name); ok {
+			return pager
+		}
+	}
+	return defaultPager
+}
+
+// runPager pipes output through the pager chosen by pagerCommand
+func runPager(output string) error {
+	pager := pagerCommand()
+
+	// PAGER=cat (or an empty command) is a common way to disable paging
+	if pager == "cat" || strings.TrimSpace(pager) == "" {
+		fmt.Print(output)
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Match git: quit if the output fits, keep colors and don't clear the screen
+	if os.Getenv("LESS") == "" {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("error creating pager pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		// Fall back to plain output if the pager is not available
+		fmt.Print(output)
+		return nil
+	}
+
+	// The user quitting the pager early closes the pipe, which is not an error
+	_, _ = io.WriteString(stdin, output)
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil
+		}
+		return fmt.Errorf("error running pager %q: %w", pager, err)
+	}
+
+	return nil
+}
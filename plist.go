@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// binaryPlistMagic starts every binary property list
+var binaryPlistMagic = []byte("bplist00")
+
+// plistData is a <data> value, kept base64-encoded so it prints as text
+type plistData string
+
+// plistDate is a <date> value, in the ISO 8601 form of XML property lists
+type plistDate string
+
+// plistEpoch is the reference date of binary property list dates
+var plistEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxBinaryPlistValues bounds the values decoded from a binary property
+// list. Objects can be referenced any number of times, so a small crafted
+// file could otherwise expand to an enormous document.
+const maxBinaryPlistValues = 1 << 20
+
+// isBinaryPlist reports whether a document is a binary property list
+func isBinaryPlist(data []byte) bool {
+	return bytes.HasPrefix(data, binaryPlistMagic)
+}
+
+// isXMLPlist reports whether an XML document is a property list
+func isXMLPlist(data []byte) bool {
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) && bytes.Contains(head, []byte("<plist"))
+}
+
+// parsePlist decodes an XML or binary property list, told apart by the magic
+// bytes of the binary format. Dictionaries decode as maps and arrays as
+// slices, so they flatten like the other formats. Integers decode as int64,
+// reals as float64, and dates and data as plistDate and plistData.
+func parsePlist(data []byte) (interface{}, error) {
+	if isBinaryPlist(data) {
+		return parseBinaryPlist(data)
+	}
+	return parseXMLPlist(data)
+}
+
+// parseXMLPlist decodes the value inside the <plist> element of an XML
+// property list
+func parseXMLPlist(data []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	start, err := nextPlistElement(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "plist" {
+		return nil, fmt.Errorf("expected a <plist> root element, got <%s>", start.Name.Local)
+	}
+
+	valueStart, err := nextPlistElement(decoder)
+	if err != nil {
+		return nil, err
+	}
+	return decodeXMLPlistValue(decoder, valueStart)
+}
+
+// nextPlistElement skips to the next start element, failing at an end element
+// or the end of the document
+func nextPlistElement(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return xml.StartElement{}, fmt.Errorf("unexpected end of property list")
+		}
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, fmt.Errorf("unexpected closing tag </%s>", t.Name.Local)
+		}
+	}
+}
+
+// decodeXMLPlistValue decodes the element that was just opened
+func decodeXMLPlistValue(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		for {
+			key, done, err := nextXMLPlistChild(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return dict, nil
+			}
+			if key.Name.Local != "key" {
+				return nil, fmt.Errorf("expected <key> in <dict>, got <%s>", key.Name.Local)
+			}
+			name, err := xmlPlistText(decoder)
+			if err != nil {
+				return nil, err
+			}
+
+			valueStart, err := nextPlistElement(decoder)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", name, err)
+			}
+			value, err := decodeXMLPlistValue(decoder, valueStart)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", name, err)
+			}
+			dict[name] = value
+		}
+	case "array":
+		array := []interface{}{}
+		for {
+			child, done, err := nextXMLPlistChild(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return array, nil
+			}
+			value, err := decodeXMLPlistValue(decoder, child)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+	case "true", "false":
+		if err := decoder.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	text, err := xmlPlistText(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		text = strings.TrimSpace(text)
+		if n, err := strconv.ParseInt(text, 0, 64); err == nil {
+			return n, nil
+		}
+		n, err := strconv.ParseUint(text, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid <integer> %q", text)
+		}
+		return n, nil
+	case "real":
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid <real> %q", text)
+		}
+		return f, nil
+	case "date":
+		return plistDate(strings.TrimSpace(text)), nil
+	case "data":
+		// Data is wrapped over several lines; the line breaks are not part of it
+		return plistData(strings.Join(strings.Fields(text), "")), nil
+	default:
+		return nil, fmt.Errorf("unsupported property list element <%s>", start.Name.Local)
+	}
+}
+
+// nextXMLPlistChild returns the next child element of a <dict> or <array>,
+// or done at its closing tag
+func nextXMLPlistChild(decoder *xml.Decoder) (xml.StartElement, bool, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, false, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t, false, nil
+		case xml.EndElement:
+			return xml.StartElement{}, true, nil
+		}
+	}
+}
+
+// xmlPlistText reads the text of the element that was just opened, up to its
+// closing tag
+func xmlPlistText(decoder *xml.Decoder) (string, error) {
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.StartElement:
+			return "", fmt.Errorf("unexpected <%s> in a text element", t.Name.Local)
+		case xml.EndElement:
+			return text.String(), nil
+		}
+	}
+}
+
+// binaryPlist holds the object table of a binary property list while it is
+// decoded
+type binaryPlist struct {
+	data        []byte
+	offsets     []uint64
+	refSize     int
+	decoding    map[uint64]bool
+	objectCount uint64
+	decoded     int
+}
+
+// parseBinaryPlist decodes a bplist00 document, starting at the top object
+// named by its trailer
+func parseBinaryPlist(data []byte) (interface{}, error) {
+	// The trailer is the last 32 bytes: 6 unused, the offset and object
+	// reference sizes, then the object count, top object and offset table
+	// position as 64-bit integers
+	if len(data) < len(binaryPlistMagic)+32 {
+		return nil, fmt.Errorf("binary property list is truncated")
+	}
+	trailer := data[len(data)-32:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	objectCount := binary.BigEndian.Uint64(trailer[8:16])
+	topObject := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 {
+		return nil, fmt.Errorf("binary property list has an invalid trailer")
+	}
+	if objectCount == 0 || topObject >= objectCount || tableOffset >= uint64(len(data)) ||
+		objectCount > (uint64(len(data))-tableOffset)/uint64(offsetSize) {
+		return nil, fmt.Errorf("binary property list has an invalid trailer")
+	}
+
+	plist := &binaryPlist{
+		data:        data,
+		offsets:     make([]uint64, objectCount),
+		refSize:     refSize,
+		decoding:    make(map[uint64]bool),
+		objectCount: objectCount,
+	}
+	for i := range plist.offsets {
+		start := tableOffset + uint64(i*offsetSize)
+		plist.offsets[i] = readBigEndian(data[start : start+uint64(offsetSize)])
+	}
+
+	return plist.object(topObject)
+}
+
+// readBigEndian reads an unsigned big-endian integer of up to 8 bytes
+func readBigEndian(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// bytesAt returns n bytes at an offset, or an error past the end of the data
+func (p *binaryPlist) bytesAt(offset, n uint64) ([]byte, error) {
+	if offset > uint64(len(p.data)) || n > uint64(len(p.data))-offset {
+		return nil, fmt.Errorf("binary property list object at offset %d runs past the end of the file", offset)
+	}
+	return p.data[offset : offset+n], nil
+}
+
+// object decodes the object with the given index. Containers that contain
+// themselves are rejected instead of recursing forever.
+func (p *binaryPlist) object(index uint64) (interface{}, error) {
+	if index >= p.objectCount {
+		return nil, fmt.Errorf("binary property list references missing object %d", index)
+	}
+	if p.decoding[index] {
+		return nil, fmt.Errorf("binary property list object %d contains itself", index)
+	}
+	p.decoding[index] = true
+	defer delete(p.decoding, index)
+
+	p.decoded++
+	if p.decoded > maxBinaryPlistValues {
+		return nil, fmt.Errorf("binary property list expands to more than %d values", maxBinaryPlistValues)
+	}
+
+	offset := p.offsets[index]
+	header, err := p.bytesAt(offset, 1)
+	if err != nil {
+		return nil, err
+	}
+	kind, info := header[0]>>4, uint64(header[0]&0x0f)
+	offset++
+
+	switch kind {
+	case 0x0:
+		switch info {
+		case 0x8:
+			return false, nil
+		case 0x9:
+			return true, nil
+		}
+		return nil, fmt.Errorf("unsupported binary property list object 0x%02x", header[0])
+	case 0x1, 0x8:
+		// Integers are 1, 2, 4 or 8 bytes, and 16 for unsigned values above
+		// the int64 range; UIDs are stored like integers
+		size := uint64(1) << info
+		if kind == 0x8 {
+			size = info + 1
+		}
+		b, err := p.bytesAt(offset, size)
+		if err != nil {
+			return nil, err
+		}
+		if size > 8 {
+			return readBigEndian(b[size-8:]), nil
+		}
+		return int64(readBigEndian(b)), nil
+	case 0x2, 0x3:
+		size := uint64(1) << info
+		b, err := p.bytesAt(offset, size)
+		if err != nil {
+			return nil, err
+		}
+		var f float64
+		switch size {
+		case 4:
+			f = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		case 8:
+			f = math.Float64frombits(binary.BigEndian.Uint64(b))
+		default:
+			return nil, fmt.Errorf("unsupported binary property list real of %d bytes", size)
+		}
+		if kind == 0x3 {
+			seconds, fraction := math.Modf(f)
+			date := plistEpoch.Add(time.Duration(seconds) * time.Second).Add(time.Duration(fraction * float64(time.Second)))
+			return plistDate(date.Format(time.RFC3339)), nil
+		}
+		return f, nil
+	}
+
+	// The remaining kinds have a length, stored in a following integer
+	// object when it doesn't fit in the header
+	count := info
+	if info == 0xf {
+		countHeader, err := p.bytesAt(offset, 1)
+		if err != nil {
+			return nil, err
+		}
+		if countHeader[0]>>4 != 0x1 {
+			return nil, fmt.Errorf("binary property list object at offset %d has an invalid length", offset-1)
+		}
+		size := uint64(1) << (countHeader[0] & 0x0f)
+		b, err := p.bytesAt(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		count = readBigEndian(b)
+		offset += 1 + size
+	}
+
+	switch kind {
+	case 0x4:
+		b, err := p.bytesAt(offset, count)
+		if err != nil {
+			return nil, err
+		}
+		return plistData(base64.StdEncoding.EncodeToString(b)), nil
+	case 0x5:
+		b, err := p.bytesAt(offset, count)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case 0x6:
+		if count > math.MaxUint64/2 {
+			return nil, fmt.Errorf("binary property list string at offset %d is too long", offset)
+		}
+		b, err := p.bytesAt(offset, count*2)
+		if err != nil {
+			return nil, err
+		}
+		units := make([]uint16, count)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case 0xa, 0xc:
+		// Sets have no order of their own and are compared like arrays
+		refs, err := p.refs(offset, count)
+		if err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, 0, len(refs))
+		for _, ref := range refs {
+			value, err := p.object(ref)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case 0xd:
+		if count > math.MaxUint64/2 {
+			return nil, fmt.Errorf("binary property list dictionary at offset %d is too large", offset)
+		}
+		refs, err := p.refs(offset, count*2)
+		if err != nil {
+			return nil, err
+		}
+		dict := make(map[string]interface{}, count)
+		for i := uint64(0); i < count; i++ {
+			key, err := p.object(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("binary property list dictionary has a non-string key %v", key)
+			}
+			value, err := p.object(refs[count+i])
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", name, err)
+			}
+			dict[name] = value
+		}
+		return dict, nil
+	}
+
+	return nil, fmt.Errorf("unsupported binary property list object 0x%02x", header[0])
+}
+
+// refs reads count object references starting at an offset
+func (p *binaryPlist) refs(offset, count uint64) ([]uint64, error) {
+	if count > uint64(len(p.data))/uint64(p.refSize) {
+		return nil, fmt.Errorf("binary property list object at offset %d runs past the end of the file", offset)
+	}
+	b, err := p.bytesAt(offset, count*uint64(p.refSize))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, count)
+	for i := range refs {
+		refs[i] = readBigEndian(b[i*p.refSize : (i+1)*p.refSize])
+	}
+	return refs, nil
+}
+
+// formatPlist renders decoded data as an XML property list with sorted
+// dictionary keys, so binary and XML files holding the same values produce
+// the same output. The XML declaration and doctype are left out, as they
+// never differ.
+func formatPlist(data interface{}) (string, error) {
+	var buffer strings.Builder
+	buffer.WriteString("<plist version=\"1.0\">\n")
+	writePlistValue(&buffer, data, 0)
+	buffer.WriteString("</plist>\n")
+	return buffer.String(), nil
+}
+
+// writePlistValue writes one value at the given indentation depth
+func writePlistValue(buffer *strings.Builder, value interface{}, depth int) {
+	indent := strings.Repeat("\t", depth)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buffer.WriteString(indent + "<dict/>\n")
+			return
+		}
+		buffer.WriteString(indent + "<dict>\n")
+		for _, key := range sortedMapKeys(v) {
+			fmt.Fprintf(buffer, "%s\t<key>%s</key>\n", indent, xmlEscape(key))
+			writePlistValue(buffer, v[key], depth+1)
+		}
+		buffer.WriteString(indent + "</dict>\n")
+	case map[interface{}]interface{}:
+		m, _ := stringKeyedMap(v)
+		writePlistValue(buffer, m, depth)
+	case []interface{}:
+		if len(v) == 0 {
+			buffer.WriteString(indent + "<array/>\n")
+			return
+		}
+		buffer.WriteString(indent + "<array>\n")
+		for _, item := range v {
+			writePlistValue(buffer, item, depth+1)
+		}
+		buffer.WriteString(indent + "</array>\n")
+	case bool:
+		fmt.Fprintf(buffer, "%s<%t/>\n", indent, v)
+	case int, int64, uint64:
+		fmt.Fprintf(buffer, "%s<integer>%d</integer>\n", indent, v)
+	case json.Number:
+		fmt.Fprintf(buffer, "%s<integer>%s</integer>\n", indent, v)
+	case float64:
+		fmt.Fprintf(buffer, "%s<real>%s</real>\n", indent, strconv.FormatFloat(v, 'g', -1, 64))
+	case plistDate:
+		fmt.Fprintf(buffer, "%s<date>%s</date>\n", indent, xmlEscape(string(v)))
+	case plistData:
+		fmt.Fprintf(buffer, "%s<data>%s</data>\n", indent, v)
+	case nil, nullValue:
+		buffer.WriteString(indent + "<string></string>\n")
+	default:
+		fmt.Fprintf(buffer, "%s<string>%s</string>\n", indent, xmlEscape(fmt.Sprintf("%v", v)))
+	}
+}
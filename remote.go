@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isURL reports whether an input argument is an HTTP(S) URL rather than a
+// local path or Git reference
+func isURL(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// urlPath returns the path component of a URL so the file extension can be
+// detected without the query string or fragment
+func urlPath(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return path.Clean("/" + parsed.Path)
+}
+
+// inputBase returns the file name used to label an input in diff headers
+func inputBase(input string) string {
+	if isURL(input) {
+		return path.Base(urlPath(input))
+	}
+	if isS3URI(input) {
+		return path.Base(s3Key(input))
+	}
+	return filepath.Base(input)
+}
+
+// fetchURL downloads an input file over HTTP(S), up to maxSize bytes. Error
+// messages from the HTTP client already include the URL.
+func fetchURL(rawURL string, timeout time.Duration, maxSize int64) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	content, err := readAllLimited(resp.Body, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	return content, nil
+}
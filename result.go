@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+)
+
+// ModifiedKey is a key present in both documents with a different value
+type ModifiedKey struct {
+	Key      string
+	OldValue interface{}
+	NewValue interface{}
+}
+
+// DiffResult is the structured outcome of comparing two documents, which
+// the summary, tree and other renderings are produced from. Keys are
+// flattened paths in the --path-style notation, sorted. Unchanged keys are
+// only collected with --show-unchanged. Values holds the new value of each
+// added key and the old value of each removed or unchanged key. Explicit
+// nulls are kept as a marker type that prints as "null".
+type DiffResult struct {
+	Added     []string
+	Removed   []string
+	Modified  []ModifiedKey
+	Unchanged []string
+	Values    map[string]interface{}
+}
+
+// Compare flattens two decoded documents and classifies their keys,
+// honoring the key case and value whitespace options
+func Compare(data1, data2 interface{}, options DiffOptions) DiffResult {
+	flat1 := make(map[string]interface{})
+	flat2 := make(map[string]interface{})
+
+	sopsdiff.FlattenDocument(data1, flat1, options.PathStyle)
+	sopsdiff.FlattenDocument(data2, flat2, options.PathStyle)
+
+	return compareFlat(flat1, flat2, options)
+}
+
+// compareFlat classifies the keys of two flattened documents
+func compareFlat(flat1, flat2 map[string]interface{}, options DiffOptions) DiffResult {
+	changes := diffFlatMaps(flat1, flat2, options)
+	if options.ShowUnchanged {
+		changes = append(changes, unchangedKeys(flat1, changes)...)
+	}
+	return newDiffResult(changes)
+}
+
+// newDiffResult groups key changes by kind
+func newDiffResult(changes []keyChange) DiffResult {
+	result := DiffResult{Values: make(map[string]interface{})}
+	for _, change := range sortedChanges(changes) {
+		switch change.Kind {
+		case changeAdded:
+			result.Added = append(result.Added, change.Key)
+			result.Values[change.Key] = change.NewValue
+		case changeRemoved:
+			result.Removed = append(result.Removed, change.Key)
+			result.Values[change.Key] = change.OldValue
+		case changeModified:
+			result.Modified = append(result.Modified, ModifiedKey{Key: change.Key, OldValue: change.OldValue, NewValue: change.NewValue})
+		case changeUnchanged:
+			result.Unchanged = append(result.Unchanged, change.Key)
+			result.Values[change.Key] = change.OldValue
+		}
+	}
+	return result
+}
+
+// HasChanges reports whether any key was added, removed or modified
+func (r DiffResult) HasChanges() bool {
+	return len(r.Added) > 0 || len(r.Removed) > 0 || len(r.Modified) > 0
+}
+
+// changes lists the result as key changes for the renderers, sorted by key
+func (r DiffResult) changes() []keyChange {
+	var changes []keyChange
+	for _, m := range r.Modified {
+		changes = append(changes, keyChange{Kind: changeModified, Key: m.Key, OldValue: m.OldValue, NewValue: m.NewValue})
+	}
+	for _, k := range r.Added {
+		changes = append(changes, keyChange{Kind: changeAdded, Key: k, NewValue: r.Values[k]})
+	}
+	for _, k := range r.Removed {
+		changes = append(changes, keyChange{Kind: changeRemoved, Key: k, OldValue: r.Values[k]})
+	}
+	for _, k := range r.Unchanged {
+		changes = append(changes, keyChange{Kind: changeUnchanged, Key: k, OldValue: r.Values[k], NewValue: r.Values[k]})
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
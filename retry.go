@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
+)
+
+// retryBaseDelay is the wait before the first retry of a transient
+// decryption error, doubled for every further attempt
+var retryBaseDelay = 500 * time.Millisecond
+
+// transientDecryptErrors are fragments of key provider error messages, in
+// lower case, that indicate throttling or an unreachable service rather than
+// a request that can never succeed
+var transientDecryptErrors = []string{
+	"throttl",
+	"rate exceeded",
+	"requestlimitexceeded",
+	"toomanyrequests",
+	"too many requests",
+	"slowdown",
+	"resource_exhausted",
+	"serviceunavailable",
+	"service unavailable",
+	"kmsinternalexception",
+	"internalfailure",
+	"deadline_exceeded",
+	"deadline exceeded",
+	"timeout",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"temporarily unavailable",
+}
+
+// isTransientDecryptError reports whether a decryption error looks like
+// throttling or a timeout that may succeed on retry. Access denied and
+// missing key errors are permanent and never retried.
+func isTransientDecryptError(err error) bool {
+	if err == nil || isMetadataNotFound(err) {
+		return false
+	}
+
+	// The key provider errors are only in the SOPS user error details
+	details := err.Error()
+	var userErr sops.UserError
+	if errors.As(err, &userErr) {
+		details += "\n" + userErr.UserError()
+	}
+
+	for _, fragment := range kmsAccessErrors {
+		if strings.Contains(details, fragment) {
+			return false
+		}
+	}
+
+	details = strings.ToLower(details)
+	for _, fragment := range transientDecryptErrors {
+		if strings.Contains(details, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// withDecryptRetries runs decrypt, retrying transient errors up to
+// --retries times with exponential backoff
+func withDecryptRetries(options DiffOptions, decrypt func() ([]byte, error)) ([]byte, error) {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		plaintext, err := decrypt()
+		if err == nil || attempt > options.Retries || !isTransientDecryptError(err) {
+			return plaintext, err
+		}
+
+		if options.Verbose {
+			fmt.Fprintf(os.Stderr, "Transient decryption error, retrying in %s (retry %d/%d): %s\n", delay, attempt, options.Retries, strings.TrimSpace(err.Error()))
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
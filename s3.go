@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Object identifies an object (and optionally one of its versions) in S3
+type s3Object struct {
+	Bucket    string
+	Key       string
+	VersionID string
+}
+
+// isS3URI reports whether an input argument is an s3:// URI
+func isS3URI(input string) bool {
+	return strings.HasPrefix(input, "s3://")
+}
+
+// parseS3URI parses s3://bucket/key, with the version given either as a
+// trailing @version or a ?versionId= query parameter. Only an @ in the last
+// path segment starts a version, so directories may contain one.
+func parseS3URI(uri string) (s3Object, error) {
+	rest := strings.TrimPrefix(uri, "s3://")
+
+	var object s3Object
+	hasVersion := false
+	if i := strings.Index(rest, "?"); i >= 0 {
+		query, err := url.ParseQuery(rest[i+1:])
+		if err != nil {
+			return s3Object{}, fmt.Errorf("invalid S3 URI %s: %w", uri, err)
+		}
+		hasVersion = query.Has("versionId")
+		object.VersionID = query.Get("versionId")
+		rest = rest[:i]
+	}
+
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return s3Object{}, fmt.Errorf("invalid S3 URI %s: expected s3://bucket/key", uri)
+	}
+	object.Bucket, object.Key = parts[0], parts[1]
+
+	if !hasVersion {
+		slash := strings.LastIndex(object.Key, "/")
+		if i := strings.LastIndex(object.Key, "@"); i > slash+1 {
+			object.Key, object.VersionID = object.Key[:i], object.Key[i+1:]
+			hasVersion = true
+		}
+	}
+	if hasVersion && object.VersionID == "" {
+		return s3Object{}, fmt.Errorf("invalid S3 URI %s: empty version", uri)
+	}
+
+	return object, nil
+}
+
+// s3Key returns the object key of an S3 URI, used to detect its format
+func s3Key(uri string) string {
+	object, err := parseS3URI(uri)
+	if err != nil {
+		return uri
+	}
+	return object.Key
+}
+
+// fetchS3Object downloads an input file from S3 using the --aws-profile and
+// --aws-region settings
+func fetchS3Object(uri string, options DiffOptions) ([]byte, error) {
+	object, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	var loadOptions []func(*config.LoadOptions) error
+	if options.AWSProfile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(options.AWSProfile))
+	}
+	if options.AWSRegion != "" {
+		loadOptions = append(loadOptions, config.WithRegion(options.AWSRegion))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS configuration: %w", err)
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	}
+	if object.VersionID != "" {
+		input.VersionId = aws.String(object.VersionID)
+	}
+
+	output, err := s3.NewFromConfig(cfg).GetObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	content, err := readAllLimited(output.Body, options.MaxFileSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading S3 object: %w", err)
+	}
+
+	return content, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3URI(t *testing.T) {
+	tests := []struct {
+		uri    string
+		object s3Object
+	}{
+		{"s3://b/prod.enc.yaml", s3Object{Bucket: "b", Key: "prod.enc.yaml"}},
+		{"s3://b/prod.enc.yaml@v1", s3Object{Bucket: "b", Key: "prod.enc.yaml", VersionID: "v1"}},
+		{"s3://b/team@x/prod.enc.yaml", s3Object{Bucket: "b", Key: "team@x/prod.enc.yaml"}},
+		{"s3://b/team@x/prod.enc.yaml@v1", s3Object{Bucket: "b", Key: "team@x/prod.enc.yaml", VersionID: "v1"}},
+		{"s3://b/team/@prod.enc.yaml", s3Object{Bucket: "b", Key: "team/@prod.enc.yaml"}},
+		{"s3://b/prod.enc.yaml?versionId=v2", s3Object{Bucket: "b", Key: "prod.enc.yaml", VersionID: "v2"}},
+		// With a query version, an @ is part of the key
+		{"s3://b/team@x/prod@enc.yaml?versionId=v2", s3Object{Bucket: "b", Key: "team@x/prod@enc.yaml", VersionID: "v2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			object, err := parseS3URI(tt.uri)
+			require.NoError(t, err)
+			assert.Equal(t, tt.object, object)
+		})
+	}
+}
+
+func TestParseS3URIRejectsInvalidURIs(t *testing.T) {
+	for _, uri := range []string{
+		"s3://b",
+		"s3:///prod.enc.yaml",
+		"s3://b/prod.enc.yaml@",
+		"s3://b/prod.enc.yaml?versionId=",
+	} {
+		t.Run(uri, func(t *testing.T) {
+			_, err := parseS3URI(uri)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// loadSchema reads the JSON schema given with --schema. Schemas written in
+// YAML are accepted too. JSON schemas are loaded by reference, so relative
+// $ref pointers resolve against the schema's directory.
+func loadSchema(path string) (*gojsonschema.Schema, error) {
+	var loader gojsonschema.JSONLoader
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading --schema: %w", err)
+		}
+
+		var data interface{}
+		if err := yaml.Unmarshal(content, &data); err != nil {
+			return nil, fmt.Errorf("error parsing --schema %s: %w", path, err)
+		}
+		loader = gojsonschema.NewGoLoader(jsonCompatible(data))
+	default:
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving --schema: %w", err)
+		}
+		loader = gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(absPath))
+	}
+
+	schema, err := gojsonschema.NewSchema(loader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// validateSchema checks a decoded document against the --schema and prints a
+// warning for every violation, or fails when --schema-strict is set
+func validateSchema(path string, data interface{}, options DiffOptions) error {
+	if options.Schema == nil {
+		return nil
+	}
+
+	result, err := options.Schema.Validate(gojsonschema.NewGoLoader(jsonCompatible(data)))
+	if err != nil {
+		return fmt.Errorf("error validating '%s' against the schema: %w", path, err)
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	for _, violation := range result.Errors() {
+		warnf(options, "WARNING: '%s' does not match the schema: %s: %s", path, violation.Field(), violation.Description())
+	}
+
+	if options.SchemaStrict {
+		return fmt.Errorf("file '%s' has %d schema violation(s), aborting as --schema-strict is enabled", path, len(result.Errors()))
+	}
+
+	return nil
+}
+
+// jsonCompatible converts a decoded YAML document to the types encoding/json
+// handles, keying every map by string
+func jsonCompatible(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		m, _ := stringKeyedMap(v)
+		result := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			result[key] = jsonCompatible(value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, value := range v {
+			result[i] = jsonCompatible(value)
+		}
+		return result
+	}
+	return data
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxFileSize is the default --max-file-size. Inputs and their
+// plaintext are held in memory several times over, so the limit stops an
+// unexpectedly large blob before it exhausts memory.
+const defaultMaxFileSize = "100MiB"
+
+// byteSizeUnits are the suffixes accepted by --max-file-size, all powers of 1024
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+	{"b", 1},
+}
+
+// parseByteSize parses a size such as 512, 64K or 100MiB into bytes
+func parseByteSize(spec string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(spec))
+
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if number, ok := strings.CutSuffix(value, u.suffix); ok {
+			value, unit = strings.TrimSpace(number), u.size
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid --max-file-size %q: use a number of bytes with an optional K, M or G suffix", spec)
+	}
+	return size * unit, nil
+}
+
+// fileTooLargeError reports an input over the --max-file-size limit
+func fileTooLargeError(limit int64) error {
+	return fmt.Errorf("input is larger than --max-file-size (%d bytes); raise the limit or use --max-file-size 0 to disable it", limit)
+}
+
+// checkFileSize fails early when a local file exceeds limit, before it is
+// read. Zero means no limit.
+func checkFileSize(path string, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > limit {
+		return fileTooLargeError(limit)
+	}
+	return nil
+}
+
+// readAllLimited reads r to the end, failing as soon as more than limit bytes
+// arrive so an oversized download or decompression stops early. Zero means no
+// limit.
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, fileTooLargeError(limit)
+	}
+	return content, nil
+}
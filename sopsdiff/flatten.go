@@ -0,0 +1,123 @@
+// Package sopsdiff holds the parts of sops-diff that other tools can build
+// on, so they produce exactly the key paths sops-diff reports.
+package sopsdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Supported notations for flattened key paths
+const (
+	PathStyleDot     = "dot"
+	PathStylePointer = "pointer"
+)
+
+// RootKeyPath names the single entry of a document that is a bare scalar. No
+// map key flattens to it in either style, since dots are escaped in keys and
+// pointers always start with a slash.
+const RootKeyPath = "."
+
+// Null marks a key explicitly set to null, so it is not conflated with a
+// missing key or an empty string
+type Null struct{}
+
+func (Null) String() string {
+	return "null"
+}
+
+// Flattener is implemented by decoded values that flatten themselves, such
+// as the elements of an XML document
+type Flattener interface {
+	FlattenKeys(prefix string, result map[string]interface{}, style string)
+}
+
+// keySegmentEscaper escapes the characters flatten uses as path separators,
+// so a key named "my.service" stays distinct from "my" -> "service"
+var keySegmentEscaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`, `[`, `\[`, `]`, `\]`)
+
+// pointerSegmentEscaper applies RFC 6901 escaping to a JSON Pointer reference token
+var pointerSegmentEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// Flatten returns the key paths of a decoded YAML, JSON or ENV document
+// exactly as the sops-diff summary reports them, mapped to their values.
+// Nested keys are joined with dots (db.password) and list items are indexed
+// in brackets (servers[0].host). Dots, brackets and backslashes inside a key
+// are escaped with a backslash, so a key named "my.service" flattens to
+// my\.service. A top-level list flattens to [0], [1], ... and a bare scalar
+// to RootKeyPath. Keys set to null map to nil.
+func Flatten(data interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	FlattenDocument(data, result, PathStyleDot)
+	for k, v := range result {
+		if _, ok := v.(Null); ok {
+			result[k] = nil
+		}
+	}
+	return result
+}
+
+// FlattenDocument flattens a whole decoded document into result, in the
+// given path style. Explicit nulls are stored as Null.
+func FlattenDocument(data interface{}, result map[string]interface{}, style string) {
+	switch data.(type) {
+	case map[string]interface{}, map[interface{}]interface{}, []interface{}, Flattener, nil:
+		FlattenAt(data, "", result, style)
+	default:
+		result[RootKeyPath] = data
+	}
+}
+
+// FlattenAt recursively flattens a nested value found at prefix into result,
+// with dot notation keys or RFC 6901 JSON Pointers with the pointer style
+func FlattenAt(data interface{}, prefix string, result map[string]interface{}, style string) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			FlattenAt(val, JoinKeyPath(prefix, k, style), result, style)
+		}
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			strKey, ok := k.(string)
+			if !ok {
+				strKey = fmt.Sprintf("%v", k)
+			}
+			FlattenAt(val, JoinKeyPath(prefix, strKey, style), result, style)
+		}
+	case []interface{}:
+		for i, val := range v {
+			FlattenAt(val, IndexKeyPath(prefix, i, style), result, style)
+		}
+	case Flattener:
+		v.FlattenKeys(prefix, result, style)
+	case nil:
+		result[prefix] = Null{}
+	default:
+		result[prefix] = v
+	}
+}
+
+// EscapeKeySegment escapes a single map key for use in a dot notation path
+func EscapeKeySegment(key string) string {
+	return keySegmentEscaper.Replace(key)
+}
+
+// JoinKeyPath appends a map key to a flattened key path
+func JoinKeyPath(prefix, key, style string) string {
+	if style == PathStylePointer {
+		return prefix + "/" + pointerSegmentEscaper.Replace(key)
+	}
+
+	if prefix == "" {
+		return EscapeKeySegment(key)
+	}
+	return prefix + "." + EscapeKeySegment(key)
+}
+
+// IndexKeyPath appends a list index to a flattened key path
+func IndexKeyPath(prefix string, index int, style string) string {
+	if style == PathStylePointer {
+		return fmt.Sprintf("%s/%d", prefix, index)
+	}
+	return fmt.Sprintf("%s[%d]", prefix, index)
+}
@@ -0,0 +1,39 @@
+package sopsdiff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatten(t *testing.T) {
+	data := map[string]interface{}{
+		"db":         map[string]interface{}{"password": "secret", "port": 5432},
+		"servers":    []interface{}{map[string]interface{}{"host": "a"}},
+		"my.service": map[string]interface{}{"a[0]": `x\y`},
+		"unset":      nil,
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"db.password":        "secret",
+		"db.port":            5432,
+		"servers[0].host":    "a",
+		`my\.service.a\[0\]`: `x\y`,
+		"unset":              nil,
+	}, Flatten(data))
+}
+
+func TestFlattenTopLevelValues(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{"[0]": "a", "[1]": "b"}, Flatten([]interface{}{"a", "b"}))
+	assert.Equal(t, map[string]interface{}{RootKeyPath: 42}, Flatten(42))
+}
+
+func TestFlattenDocumentPointerStyle(t *testing.T) {
+	data := map[string]interface{}{
+		"a/b": map[string]interface{}{"c~d": []interface{}{nil}},
+	}
+
+	flat := make(map[string]interface{})
+	FlattenDocument(data, flat, PathStylePointer)
+	assert.Equal(t, map[string]interface{}{"/a~1b/c~0d/0": Null{}}, flat)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// spinnerDelay is how long decryption may take before the spinner appears,
+// so fast local age or PGP decryption doesn't flicker
+var spinnerDelay = 300 * time.Millisecond
+
+// spinnerFrames are drawn in turn while the spinner runs
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// startSpinner shows message with a spinner on stderr until the returned
+// function is called, which clears the line again. It only runs when both
+// stdout and stderr are terminals, and not under --quiet or under --verbose,
+// whose messages would interleave with it.
+func startSpinner(message string, options DiffOptions) (stop func()) {
+	if options.Quiet || options.Verbose || !isatty.IsTerminal(os.Stdout.Fd()) || !isatty.IsTerminal(os.Stderr.Fd()) {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		select {
+		case <-done:
+			return
+		case <-time.After(spinnerDelay):
+		}
+
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			fmt.Fprintf(os.Stderr, "\r%s %s", message, spinnerFrames[frame%len(spinnerFrames)])
+			select {
+			case <-done:
+				fmt.Fprint(os.Stderr, "\r\033[K")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
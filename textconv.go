@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// TextConv writes the decrypted content of a file to stdout, for use as a Git
+// textconv filter (git config diff.sops.textconv "sops-diff textconv"). Files
+// without SOPS metadata are written unchanged, so plaintext revisions of a
+// file still show up in git diff and git log -p.
+func TextConv(filePath string, options DiffOptions) error {
+	content, err := readInput(filePath, false, options)
+	if err != nil {
+		return &ReadError{Path: filePath, Err: err}
+	}
+
+	if err := applyKeyProviderEnv(options); err != nil {
+		return err
+	}
+
+	format := detectInputFormat(filePath, content, options)
+	decrypted, err := decryptBytes(content, sopsStoreFormat(format), options)
+	err = plainDocumentError(content, format, err)
+	if isMetadataNotFound(err) {
+		decrypted, err = content, nil
+	}
+	if err != nil {
+		return newDecryptError(filePath, err, options)
+	}
+
+	if _, err := os.Stdout.Write(decrypted); err != nil {
+		return fmt.Errorf("error writing decrypted content: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeK8sSecretData base64-decodes the values under the top-level "data" key
+// of a Kubernetes Secret manifest so the plaintext can be compared. Values that
+// aren't valid base64 or don't decode to text are left untouched, and
+// "stringData" is already plaintext.
+func decodeK8sSecretData(data interface{}) interface{} {
+	doc, ok := data.(map[string]interface{})
+	if !ok {
+		return data
+	}
+
+	if kind, exists := doc["kind"]; exists && kind != "Secret" {
+		return data
+	}
+
+	secretData, ok := doc["data"].(map[string]interface{})
+	if !ok {
+		return data
+	}
+
+	for k, v := range secretData {
+		encoded, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || !utf8.Valid(decoded) {
+			continue
+		}
+
+		secretData[k] = string(decoded)
+	}
+
+	return data
+}
+
+// expandJSONStrings replaces every string value holding a JSON object or
+// array with the same JSON pretty-printed over several lines, keys sorted,
+// for --expand-json-strings. A change to one field of an embedded document
+// then shows as a change to one line instead of to an opaque string. Strings
+// that don't parse, and those holding bare JSON scalars, are left untouched.
+func expandJSONStrings(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = expandJSONStrings(val)
+		}
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			v[k] = expandJSONStrings(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = expandJSONStrings(val)
+		}
+	case string:
+		if expanded, ok := prettyJSONString(v); ok {
+			return expanded
+		}
+	}
+	return data
+}
+
+// prettyJSONString pretty-prints a string holding a JSON object or array
+func prettyJSONString(str string) (string, bool) {
+	trimmed := strings.TrimSpace(str)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return "", false
+	}
+
+	document, err := unmarshalJSON([]byte(trimmed))
+	if err != nil {
+		return "", false
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), true
+}
+
+// stripSopsMetadata removes the top-level "sops" key, which only a file that
+// was decrypted in place, or copied with its metadata, still carries
+func stripSopsMetadata(data interface{}) interface{} {
+	if doc, ok := data.(map[string]interface{}); ok {
+		delete(doc, "sops")
+	}
+	return data
+}
+
+// stripSopsEnvMetadata removes the sops_ keys in which SOPS stores the
+// metadata of an env file
+func stripSopsEnvMetadata(env *envFile) {
+	keys := env.Keys[:0]
+	for _, key := range env.Keys {
+		if strings.HasPrefix(key, "sops_") {
+			delete(env.Values, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	env.Keys = keys
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Supported renderings of the summary of key changes
+const (
+	summaryFormatFlat = "flat"
+	summaryFormatTree = "tree"
+)
+
+// changeTreeNode groups the changed keys that share a path prefix
+type changeTreeNode struct {
+	children map[string]*changeTreeNode
+	changes  map[string][]string
+}
+
+// newChangeTreeNode returns an empty tree node
+func newChangeTreeNode() *changeTreeNode {
+	return &changeTreeNode{
+		children: make(map[string]*changeTreeNode),
+		changes:  make(map[string][]string),
+	}
+}
+
+// renderChangeTree renders changed keys as an indented tree grouped by common
+// prefixes, with the change marker on each leaf
+func renderChangeTree(changes []keyChange, options DiffOptions) string {
+	root := newChangeTreeNode()
+	for _, change := range changes {
+		segments := splitKeyPath(change.Key, options.PathStyle)
+
+		node := root
+		for _, segment := range segments[:len(segments)-1] {
+			child, ok := node.children[segment]
+			if !ok {
+				child = newChangeTreeNode()
+				node.children[segment] = child
+			}
+			node = child
+		}
+
+		leaf := segments[len(segments)-1]
+		node.changes[leaf] = append(node.changes[leaf], options.Markers.marker(change.Kind)+" "+leaf+changeAnnotation(change, options))
+	}
+
+	var buffer strings.Builder
+	writeChangeTree(&buffer, root, 0)
+	return buffer.String()
+}
+
+// writeChangeTree writes a node's changed keys and subtrees in sorted order
+func writeChangeTree(buffer *strings.Builder, node *changeTreeNode, depth int) {
+	names := make(map[string]bool)
+	for name := range node.children {
+		names[name] = true
+	}
+	for name := range node.changes {
+		names[name] = true
+	}
+
+	indent := strings.Repeat("  ", depth)
+	for _, name := range sortedKeySet(names) {
+		lines := node.changes[name]
+		sort.Strings(lines)
+		for _, line := range lines {
+			buffer.WriteString(indent + line + "\n")
+		}
+
+		if child, ok := node.children[name]; ok {
+			buffer.WriteString(indent + name + "\n")
+			writeChangeTree(buffer, child, depth+1)
+		}
+	}
+}
+
+// splitKeyPath splits a flattened key path back into its unescaped segments.
+// In dot notation, list indices are kept as "[N]" segments.
+func splitKeyPath(path, style string) []string {
+	if path == rootKeyPath {
+		return []string{rootKeyPath}
+	}
+
+	if style == pathStylePointer {
+		segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		for i, segment := range segments {
+			segments[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+		}
+		return segments
+	}
+
+	var segments []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			current.WriteByte(path[i])
+		case c == '.':
+			segments = append(segments, current.String())
+			current.Reset()
+		case c == '[':
+			if current.Len() > 0 {
+				segments = append(segments, current.String())
+				current.Reset()
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				current.WriteString(path[i:])
+				i = len(path)
+				continue
+			}
+			current.WriteString(path[i : i+end+1])
+			i += end
+			if i+1 < len(path) && path[i+1] == '.' {
+				i++
+			}
+			segments = append(segments, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 || len(segments) == 0 {
+		segments = append(segments, current.String())
+	}
+
+	return segments
+}
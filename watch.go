@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait after the last change before re-running
+// the diff, so an editor save followed by sops re-encrypting triggers one run
+const watchDebounce = 300 * time.Millisecond
+
+// watchDiff shows the diff and re-runs it whenever either input changes,
+// until interrupted
+func watchDiff(file1Path, file2Path string, options DiffOptions) error {
+	for _, path := range []string{file1Path, file2Path} {
+		if isURL(path) || isS3URI(path) || isZipEntry(path) || (options.GitSupport && isGitRef(path)) {
+			return fmt.Errorf("--watch only supports local files, not %s", path)
+		}
+		if isDirectory(path) {
+			return fmt.Errorf("--watch does not support directories: %s", path)
+		}
+	}
+
+	// The screen is redrawn on every change, so paging would block updates
+	options.NoPager = true
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// Watch the parent directories, since editors and sops often replace a
+	// file by renaming a new one over it, which drops a watch on the file
+	watched := make(map[string]bool)
+	for _, path := range []string{file1Path, file2Path} {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %w", path, err)
+		}
+		watched[absPath] = true
+
+		if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+			return fmt.Errorf("error watching %s: %w", path, err)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	redraw := func() {
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Watching %s and %s (Ctrl-C to exit)\n\n", file1Path, file2Path)
+		if err := runDiff(file1Path, file2Path, options); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+	redraw()
+
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if watched[event.Name] && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce.Reset(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "Watch error: %v\n", err)
+		case <-debounce.C:
+			redraw()
+		case <-interrupt:
+			fmt.Println()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/saltydogtechnology/sops-diff/sopsdiff"
+)
+
+// xmlNode is an XML element with attributes or child elements. Elements with
+// only text are decoded as plain strings, and repeated child elements as a
+// []interface{} so they flatten with the usual index notation.
+type xmlNode struct {
+	Attrs    map[string]string
+	Children map[string]interface{}
+	Text     []string
+}
+
+// parseXML decodes an XML document into a map holding its root element.
+// Namespace prefixes are kept as part of the element and attribute names.
+func parseXML(data []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	type element struct {
+		name string
+		node *xmlNode
+	}
+	var stack []element
+	var root map[string]interface{}
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Attrs: make(map[string]string), Children: make(map[string]interface{})}
+			for _, attr := range t.Attr {
+				node.Attrs[xmlName(attr.Name)] = attr.Value
+			}
+			stack = append(stack, element{name: xmlName(t.Name), node: node})
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1].name != xmlName(t.Name) {
+				return nil, fmt.Errorf("unexpected closing tag </%s>", xmlName(t.Name))
+			}
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			value := xmlNodeValue(current.node)
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("multiple root elements")
+				}
+				root = map[string]interface{}{current.name: value}
+				continue
+			}
+
+			parent := stack[len(stack)-1].node
+			switch existing := parent.Children[current.name].(type) {
+			case nil:
+				parent.Children[current.name] = value
+			case []interface{}:
+				parent.Children[current.name] = append(existing, value)
+			default:
+				parent.Children[current.name] = []interface{}{existing, value}
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text != "" && len(stack) > 0 {
+				node := stack[len(stack)-1].node
+				node.Text = append(node.Text, text)
+			}
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unclosed element <%s>", stack[len(stack)-1].name)
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+
+	return root, nil
+}
+
+// xmlName returns a name with its namespace prefix, as written in the document
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// xmlNodeValue simplifies elements that only contain text to a string
+func xmlNodeValue(node *xmlNode) interface{} {
+	if len(node.Attrs) == 0 && len(node.Children) == 0 && len(node.Text) <= 1 {
+		return strings.Join(node.Text, "")
+	}
+	return node
+}
+
+// FlattenKeys flattens an element into the result map. Attributes are
+// appended with "@" (root.server@host) and text next to attributes or child
+// elements is stored under "#text", indexed when it is mixed content.
+func (node *xmlNode) FlattenKeys(prefix string, result map[string]interface{}, style string) {
+	for name, value := range node.Attrs {
+		if style == pathStylePointer {
+			result[sopsdiff.JoinKeyPath(prefix, "@"+name, style)] = value
+		} else {
+			result[prefix+"@"+sopsdiff.EscapeKeySegment(name)] = value
+		}
+	}
+
+	for name, child := range node.Children {
+		sopsdiff.FlattenAt(child, sopsdiff.JoinKeyPath(prefix, name, style), result, style)
+	}
+
+	textPath := sopsdiff.JoinKeyPath(prefix, "#text", style)
+	switch len(node.Text) {
+	case 0:
+	case 1:
+		result[textPath] = node.Text[0]
+	default:
+		for i, text := range node.Text {
+			result[sopsdiff.IndexKeyPath(textPath, i, style)] = text
+		}
+	}
+}
+
+// formatXML renders decoded XML with sorted attributes and child elements, so
+// documents that only differ in ordering produce the same output
+func formatXML(data interface{}) (string, error) {
+	root, ok := data.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("expected an XML document, got %T", data)
+	}
+
+	var buffer strings.Builder
+	for _, name := range sortedMapKeys(root) {
+		writeXMLElement(&buffer, name, root[name], 0)
+	}
+	return buffer.String(), nil
+}
+
+// writeXMLElement writes one element, or one element per item of a repeated
+// element, at the given indentation depth
+func writeXMLElement(buffer *strings.Builder, name string, value interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			writeXMLElement(buffer, name, item, depth)
+		}
+	case *xmlNode:
+		buffer.WriteString(indent + "<" + name)
+		for _, attr := range sortedStringKeys(v.Attrs) {
+			fmt.Fprintf(buffer, " %s=\"%s\"", attr, xmlEscape(v.Attrs[attr]))
+		}
+
+		switch {
+		case len(v.Children) == 0 && len(v.Text) == 0:
+			buffer.WriteString("/>\n")
+		case len(v.Children) == 0 && len(v.Text) == 1:
+			fmt.Fprintf(buffer, ">%s</%s>\n", xmlEscape(v.Text[0]), name)
+		default:
+			buffer.WriteString(">\n")
+			for _, text := range v.Text {
+				buffer.WriteString(indent + "  " + xmlEscape(text) + "\n")
+			}
+			for _, child := range sortedMapKeys(v.Children) {
+				writeXMLElement(buffer, child, v.Children[child], depth+1)
+			}
+			fmt.Fprintf(buffer, "%s</%s>\n", indent, name)
+		}
+	default:
+		fmt.Fprintf(buffer, "%s<%s>%s</%s>\n", indent, name, xmlEscape(fmt.Sprintf("%v", v)), name)
+	}
+}
+
+// xmlEscape escapes text for use in element content and attribute values
+func xmlEscape(text string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(text))
+	return buffer.String()
+}
+
+// sortedMapKeys returns the keys of a map in sorted order
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedStringKeys returns the keys of a string map in sorted order
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}